@@ -2,9 +2,20 @@ config = {
   -- username
   username    = os.getenv("USER"), -- "anonymous" .. math.random(1, 256),
 
+  -- password, unless given with -password or $GOLAND_PASSWORD.
+  -- run with -register the first time to create the account.
+  --password    = "hunter2",
+
   -- server
   server      = "127.0.0.1:61507",
 
+  -- preferred wire codec: "gob" or "jsonl"
+  codec       = "gob",
+
+  -- seconds to draw other players and objects in the past, so they move
+  -- smoothly between server updates. 0 shows them as soon as they arrive.
+  interpdelay = 0.1,
+
   -- logging & debugging
   logfile     = "client.log",
 
@@ -1,8 +1,8 @@
 package main
 
 import (
+	"fmt"
 	"github.com/errnoh/termbox/panel"
-	"github.com/mischief/gochanio"
 	"github.com/mischief/goland/game"
 	"github.com/mischief/goland/game/gnet"
 	"github.com/mischief/goland/game/gutil"
@@ -11,6 +11,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"os"
 	"reflect"
 	"sync"
 	"time"
@@ -18,27 +19,34 @@ import (
 
 const (
 	FPS_LIMIT = 23
-)
 
-var (
-	CARDINALS = map[rune]game.Action{
-		'w': game.DIR_UP,
-		'k': game.DIR_UP,
-		'a': game.DIR_LEFT,
-		'h': game.DIR_LEFT,
-		's': game.DIR_DOWN,
-		'j': game.DIR_DOWN,
-		'd': game.DIR_RIGHT,
-		'l': game.DIR_RIGHT,
-		',': game.ACTION_ITEM_PICKUP,
-		'x': game.ACTION_ITEM_DROP,
-		'i': game.ACTION_ITEM_LIST_INVENTORY,
-	}
+	CLIENT_NAME    = "goland-client"
+	CLIENT_VERSION = "0.1"
+
+	// our password, if not on the command line where ps shows it
+	PASSWORD_ENV = "GOLAND_PASSWORD"
+
+	// how long to wait for the server to answer our hello
+	HANDSHAKE_TIMEOUT = 10 * time.Second
+
+	// how often we ping, and how long the server may stay silent
+	PING_INTERVAL  = 2 * time.Second
+	SERVER_TIMEOUT = 10 * time.Second
+
+	// reconnect backoff, and how long the server keeps our player
+	RECONNECT_DELAY     = 1 * time.Second
+	RECONNECT_DELAY_MAX = 8 * time.Second
+	RECONNECT_TIMEOUT   = 30 * time.Second
 )
 
 type Game struct {
 	player game.Object
-	pm     sync.Mutex
+	pm     sync.Mutex // protects player, inputseq, pending and serverpos
+
+	inputseq     uint32          // Seq of our last Taction
+	pending      []*pendingInput // moves the server hasn't run yet
+	serverpos    image.Point     // where the last snapshot put our player
+	hasserverpos bool            // whether there's been one
 
 	Terminal
 	logpanel  *LogPanel
@@ -54,24 +62,61 @@ type Game struct {
 
 	config *gutil.LuaConfig
 
-	ServerCon net.Conn
+	dispatcher *gnet.Dispatcher // handlers for server packets
+
+	addr        string // server address
+	username    string // who we log in as
+	password    string // and how
+	register    bool   // make the account on our first login
+	resumeToken string // from the server, to get our player back after a drop
+
+	ServerCon *gnet.Conn
+	cm        sync.Mutex // protects ServerCon and resumeToken
+
+	rtt     time.Duration // last measured round trip to the server
+	pingseq uint32
+	rm      sync.Mutex // protects rtt and pingseq
+
+	// world states from the server we may get deltas against. only
+	// touched by the packet reader.
+	snaps *game.SnapshotTracker
+
+	interp *Interpolator // smooths out how remote objects move
 
-	ServerRChan <-chan interface{}
-	ServerWChan chan<- interface{}
+	// Connect waits on joinc for Rjoin. inworld is set once it arrives,
+	// and only touched by the packet reader.
+	joinc   chan error
+	inworld bool
+
+	replay    *MatchPlayer // the match we're watching instead, if any
+	spectator *Spectator   // our camera, if we're watching a live game
 }
 
 func NewGame(config *gutil.LuaConfig) *Game {
 	g := Game{config: config}
+
+	// real IDs come from the server, ours are only for placeholders
+	game.IDs = game.NewPlaceholderIDAllocator()
+
 	g.Objects = game.NewGameObjectMap()
 
 	g.CloseChan = make(chan bool, 1)
 
+	g.setupHandlers()
+
 	g.player = game.NewGameObject("")
 
+	delay := DEFAULT_INTERP_DELAY
+	if conf, err := config.Get("interpdelay", reflect.Float64); err == nil {
+		delay = time.Duration(conf.(float64) * float64(time.Second))
+	}
+	g.interp = NewInterpolator(delay)
+	g.snaps = game.NewSnapshotTracker()
+
 	g.mainpanel = panel.MainScreen()
 	g.panels = make(map[string]panel.Panel)
 
-	g.panels["stats"] = NewStatsPanel()
+	g.panels["stats"] = NewStatsPanel(&g)
 	g.panels["view"] = NewViewPanel(&g)
 	g.panels["log"] = NewLogPanel()
 	g.panels["player"] = NewPlayerPanel(&g)
@@ -89,7 +134,25 @@ func NewGame(config *gutil.LuaConfig) *Game {
 
 func (g *Game) SendPacket(p *gnet.Packet) {
 	log.Printf("Game: SendPacket: %s", p)
-	g.ServerWChan <- p
+
+	if err := gnet.Validate(p, gnet.CLIENT_TO_SERVER); err != nil {
+		log.Printf("Game: SendPacket: not sending: %s", err)
+		return
+	}
+
+	g.cm.Lock()
+	c := g.ServerCon
+	g.cm.Unlock()
+
+	// between a failed reconnect and the next one
+	if c == nil {
+		log.Printf("Game: SendPacket: not connected, dropping %s", p)
+		return
+	}
+
+	if err := c.WritePacket(p); err != nil {
+		log.Printf("Game: SendPacket: %s", err)
+	}
 }
 
 func (g *Game) GetPlayer() game.Object {
@@ -99,6 +162,18 @@ func (g *Game) GetPlayer() game.Object {
 	return g.player
 }
 
+// where to draw o right now. our own player is always where we think it
+// is, everyone else is interpolated.
+func (g *Game) RenderPos(o game.Object) image.Point {
+	if o != g.GetPlayer() {
+		if pos, ok := g.interp.Pos(o.GetID(), time.Now()); ok {
+			return pos
+		}
+	}
+
+	return image.Pt(o.GetPos())
+}
+
 func (g *Game) Run() {
 
 	g.Start()
@@ -135,60 +210,19 @@ func (g *Game) Run() {
 func (g *Game) Start() {
 	log.Print("Game: Starting")
 
-	// network setup
-	server, err := g.config.Get("server", reflect.String)
-	if err != nil {
-		log.Fatal("Game: Start: missing server in config: %s", err)
+	var err error
+	if *replayfile != "" {
+		err = g.StartReplay(*replayfile)
+	} else {
+		err = g.StartOnline()
 	}
 
-	con, err := net.Dial("tcp", server.(string))
 	if err != nil {
-		log.Fatalf("Game: Start: Dial: %s", err)
+		// the terminal isn't up yet, so make sure the user sees why
+		fmt.Fprintf(os.Stderr, "%s: %s\n", CLIENT_NAME, err)
+		log.Fatalf("Game: Start: %s", err)
 	}
 
-	g.ServerCon = con
-
-	g.ServerRChan = chanio.NewReader(g.ServerCon)
-	g.ServerWChan = chanio.NewWriter(g.ServerCon)
-
-	if g.ServerRChan == nil || g.ServerWChan == nil {
-		log.Fatal("Game: Start: can't establish channels")
-	}
-
-	// login
-	username, err := g.config.Get("username", reflect.String)
-	if err != nil {
-		log.Fatal("Game: Start: missing username in config: %s", err)
-	}
-
-	g.ServerWChan <- gnet.NewPacket("Tconnect", username)
-
-	// request the map from server
-	g.ServerWChan <- gnet.NewPacket("Tloadmap", nil)
-
-	// request the object we control
-	// XXX: the delay is to fix a bug regarding ordering of packets.
-	// if the client gets the response to this before he is notified
-	// that the object exists, it will barf, so we delay this request.
-	time.AfterFunc(50*time.Millisecond, func() {
-		g.ServerWChan <- gnet.NewPacket("Tgetplayer", nil)
-	})
-
-	// anonymous function that reads packets from the server
-	go func(r <-chan interface{}) {
-		for x := range r {
-			p, ok := x.(*gnet.Packet)
-			if !ok {
-				log.Printf("Game: Read: Bogus server packet %#v", x)
-				continue
-			}
-
-			g.HandlePacket(p)
-		}
-		log.Println("Game: Read: Disconnected from server!")
-		io.WriteString(g.logpanel, "Disconnected from server!")
-	}(g.ServerRChan)
-
 	// terminal/keyhandling setup
 	g.Terminal.Start()
 
@@ -198,24 +232,26 @@ func (g *Game) Start() {
 	// ESC to quit
 	g.HandleKey(termbox.KeyEsc, func(ev termbox.Event) { g.CloseChan <- false })
 
+	// watching, not playing
+	if g.replay != nil {
+		g.replayKeys()
+		return
+	}
+
 	// Enter to chat
 	g.HandleKey(termbox.KeyEnter, func(ev termbox.Event) { g.SetInputHandler(g.chatpanel) })
 
+	// spectators chat, but move the camera instead of a player
+	if g.spectator != nil {
+		g.spectatorKeys()
+		return
+	}
+
 	// convert to func SetupDirections()
-	for k, v := range CARDINALS {
+	for k, v := range game.KeyActions {
 		func(c rune, d game.Action) {
 			g.HandleRune(c, func(_ termbox.Event) {
-				// lol collision
-				p := &gnet.Packet{"Taction", CARDINALS[c]}
-				g.SendPacket(p)
-				offset := game.DirTable[d]
-				g.pm.Lock()
-				defer g.pm.Unlock()
-				oldposx, oldposy := g.player.GetPos()
-				newpos := image.Pt(oldposx+offset.X, oldposy+offset.Y)
-				if g.Map.CheckCollision(nil, newpos) {
-					g.player.SetPos(newpos.X, newpos.Y)
-				}
+				g.SendInput(d)
 			})
 
 			/*
@@ -232,6 +268,265 @@ func (g *Game) Start() {
 
 }
 
+// StartOnline works out where and who we are and joins the server
+func (g *Game) StartOnline() error {
+	// network setup
+	g.addr = *server
+	if g.addr == "" {
+		conf, err := g.config.Get("server", reflect.String)
+		if err != nil {
+			log.Fatal("Game: Start: missing server in config: %s", err)
+		}
+		g.addr = conf.(string)
+	}
+
+	// login
+	g.username = *username
+	if g.username == "" {
+		conf, err := g.config.Get("username", reflect.String)
+		if err != nil {
+			log.Fatal("Game: Start: missing username in config: %s", err)
+		}
+		g.username = conf.(string)
+	}
+
+	g.password = *password
+	if g.password == "" {
+		g.password = os.Getenv(PASSWORD_ENV)
+	}
+	if g.password == "" {
+		if conf, err := g.config.Get("password", reflect.String); err == nil {
+			g.password = conf.(string)
+		}
+	}
+
+	g.register = *register
+
+	if *spectate {
+		g.spectator = NewSpectator(g)
+	}
+
+	return g.Connect()
+}
+
+// Connect dials the server, says hello and waits to join the world.
+// If we have a resume token from an earlier connection, we ask
+// for our old player back.
+func (g *Game) Connect() error {
+	con, err := net.Dial("tcp", g.addr)
+	if err != nil {
+		return fmt.Errorf("can't connect to %s: %s", g.addr, err)
+	}
+
+	// everyone starts out in the default codec; the handshake may switch us
+	codec, _ := gnet.GetCodec(gnet.DEFAULT_CODEC)
+	c := gnet.NewConn(con, codec)
+
+	if err := g.Handshake(c); err != nil {
+		c.Close()
+		return err
+	}
+
+	g.cm.Lock()
+	g.ServerCon = c
+	g.cm.Unlock()
+
+	// the server tells a new connection about everything from scratch
+	g.ResetSnapshots()
+	g.ResetInputs()
+
+	joinc := make(chan error, 1)
+	g.joinc = joinc
+	g.inworld = false
+
+	// anonymous function that reads packets from the server
+	go func(c *gnet.Conn) {
+		for {
+			// the server answers our pings, so silence means it's gone
+			c.SetReadDeadline(time.Now().Add(SERVER_TIMEOUT))
+
+			p, err := c.ReadPacket()
+			if err != nil {
+				if err != io.EOF {
+					log.Printf("Game: Read: %s", err)
+				}
+				break
+			}
+
+			g.HandlePacket(p)
+		}
+		// Connect is still waiting, let it deal with this
+		if !g.inworld {
+			joinc <- fmt.Errorf("disconnected before joining the world")
+			return
+		}
+
+		log.Println("Game: Read: Disconnected from server!")
+		io.WriteString(g.logpanel, "Disconnected from server!")
+
+		g.Reconnect(c)
+	}(c)
+
+	// the server answers our hello with the map, our player and
+	// everything we can see, all in one Rjoin
+	select {
+	case err = <-joinc:
+	case <-time.After(HANDSHAKE_TIMEOUT):
+		err = fmt.Errorf("server didn't let us join the world")
+	}
+
+	if err != nil {
+		// so the reader doesn't try to reconnect
+		g.cm.Lock()
+		g.ServerCon = nil
+		g.cm.Unlock()
+
+		c.Close()
+		return err
+	}
+
+	// keep the connection alive and measure our round trip
+	go g.Pinger(c)
+
+	return nil
+}
+
+// Pinger sends a Tping every PING_INTERVAL until c is replaced or closed
+func (g *Game) Pinger(c *gnet.Conn) {
+	t := time.NewTicker(PING_INTERVAL)
+	defer t.Stop()
+
+	for _ = range t.C {
+		g.cm.Lock()
+		current := g.ServerCon == c
+		g.cm.Unlock()
+
+		if !current {
+			return
+		}
+
+		g.rm.Lock()
+		g.pingseq++
+		ping := gnet.NewPing(g.pingseq, g.rtt)
+		g.rm.Unlock()
+
+		// not through SendPacket, pings would flood the log
+		if err := c.WritePacket(gnet.NewPacket("Tping", ping)); err != nil {
+			return
+		}
+	}
+}
+
+// RTT is the last measured round trip time to the server
+func (g *Game) RTT() time.Duration {
+	g.rm.Lock()
+	defer g.rm.Unlock()
+
+	return g.rtt
+}
+
+// Reconnect tries to get back into the game after losing old.
+// The server keeps our player around for a while if we have a resume token.
+func (g *Game) Reconnect(old *gnet.Conn) {
+	g.cm.Lock()
+	current := g.ServerCon == old
+	token := g.resumeToken
+	g.cm.Unlock()
+
+	if !current || token == "" {
+		return
+	}
+
+	delay := RECONNECT_DELAY
+	deadline := time.Now().Add(RECONNECT_TIMEOUT)
+
+	for time.Now().Before(deadline) {
+		io.WriteString(g.logpanel, fmt.Sprintf("Reconnecting in %s...", delay))
+		time.Sleep(delay)
+
+		// the server will tell us about everything again
+		for o := range g.Objects.Chan() {
+			g.Objects.RemoveObject(o)
+		}
+
+		err := g.Connect()
+		if err == nil {
+			io.WriteString(g.logpanel, "Reconnected.")
+			return
+		}
+
+		log.Printf("Game: Reconnect: %s", err)
+
+		if _, rejected := err.(*gnet.Reject); rejected {
+			io.WriteString(g.logpanel, err.Error())
+			return
+		}
+
+		if delay *= 2; delay > RECONNECT_DELAY_MAX {
+			delay = RECONNECT_DELAY_MAX
+		}
+	}
+
+	io.WriteString(g.logpanel, "Giving up on reconnecting.")
+}
+
+// Handshake sends our hello on c and waits for the server to accept or
+// reject it. Nothing else may be sent or read on c until this returns.
+func (g *Game) Handshake(c *gnet.Conn) error {
+	hello := gnet.NewHello(CLIENT_NAME, CLIENT_VERSION, g.username, "resume", "ping")
+	if g.spectator != nil {
+		hello.Features = append(hello.Features, "spectate")
+	}
+
+	// ask for our preferred codec, if any
+	if codec, err := g.config.Get("codec", reflect.String); err == nil {
+		hello.Codecs = []string{codec.(string)}
+	}
+
+	g.cm.Lock()
+	hello.ResumeToken = g.resumeToken
+	g.cm.Unlock()
+
+	log.Printf("Game: Handshake: %s", hello)
+
+	w, err := gnet.ClientHello(c, hello, HANDSHAKE_TIMEOUT)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Game: Handshake: accepted %s", w)
+
+	// without it, we'd get a player
+	if g.spectator != nil && !gnet.HasFeature(w.Features, "spectate") {
+		return fmt.Errorf("server doesn't allow spectators")
+	}
+
+	g.cm.Lock()
+	g.resumeToken = w.ResumeToken
+	g.cm.Unlock()
+
+	return g.Login(c)
+}
+
+// Login sends our password after Rconnect and waits for the server to
+// let us in. Only called from Handshake.
+func (g *Game) Login(c *gnet.Conn) error {
+	login := &gnet.Login{Password: g.password, Register: g.register}
+
+	log.Printf("Game: Login: %s %s", g.username, login)
+
+	name, err := gnet.ClientLogin(c, login, HANDSHAKE_TIMEOUT)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Game: Login: logged in as %s", name)
+
+	// the account exists now, reconnects log in to it
+	g.register = false
+	return nil
+}
+
 func (g *Game) End() {
 	log.Print("Game: Ending")
 	g.Terminal.End()
@@ -252,6 +547,12 @@ func (g *Game) Update(delta time.Duration) {
 
 	g.RunInputHandlers()
 
+	if g.replay != nil {
+		g.replay.Update(delta)
+	} else {
+		g.ExpireInputs()
+	}
+
 	for o := range g.Objects.Chan() {
 		o.Update(delta)
 	}
@@ -274,74 +575,92 @@ func (g *Game) Draw() {
 
 // deal with gnet.Packets received from the server
 func (g *Game) HandlePacket(pk *gnet.Packet) {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Printf("Game: HandlePacket: %s", err)
-		}
-	}()
+	if pk.Tag != "Rpong" && pk.Tag != "Rsnapshot" {
+		log.Printf("Game: HandlePacket: %s", pk)
+	}
 
-	log.Printf("Game: HandlePacket: %s", pk)
-	switch pk.Tag {
+	if err := g.dispatcher.Dispatch(pk); err != nil {
+		log.Printf("Game: HandlePacket: %s", err)
+	}
+}
 
-	// Rchat: we got a text message
-	case "Rchat":
-		chatline := pk.Data.(string)
-		io.WriteString(g.logpanel, chatline)
+// register our handlers for server packets
+func (g *Game) setupHandlers() {
+	g.dispatcher = gnet.NewDispatcher(gnet.SERVER_TO_CLIENT)
 
-	// Raction: something moved on the server
-	// Need to update the objects (sync client w/ srv)
-	case "Raction":
-		robj := pk.Data.(game.Object) // remote object
+	g.dispatcher.Handle("Rchat", g.handleChat)
+	g.dispatcher.Handle("Rerror", g.handleError)
+	g.dispatcher.Handle("Rjoin", g.handleJoin)
+	g.dispatcher.Handle("Rsnapshot", g.handleSnapshot)
+	g.dispatcher.Handle("Rpong", g.handlePong)
+	g.dispatcher.Handle("Rbye", g.handleBye)
+}
 
-		for o := range g.Objects.Chan() {
-			if o.GetID() == robj.GetID() {
-				o.SetPos(robj.GetPos())
-			} /*else if o.GetTag("item") {
-				item := g.Objects.FindObjectByID(o.GetID())
-				if item.GetTag("gettable") {
-					item.SetPos(o.GetPos())
-				} else {
-					g.Objects.RemoveObject(item)
-				}
-			}	*/
-		}
+// Rpong: our ping came back
+func (g *Game) handlePong(pk *gnet.Packet) error {
+	ping := pk.Data.(*gnet.Ping)
+
+	g.rm.Lock()
+	g.rtt = ping.Since()
+	g.rm.Unlock()
+
+	return nil
+}
+
+// Rbye: the server is hanging up on purpose, so don't try to resume
+func (g *Game) handleBye(pk *gnet.Packet) error {
+	g.cm.Lock()
+	g.resumeToken = ""
+	g.cm.Unlock()
+
+	io.WriteString(g.logpanel, pk.Data.(string))
+	return nil
+}
 
-		// Rnewobject: new object we need to track
-	case "Rnewobject":
-		obj := pk.Data.(game.Object)
-		g.Objects.Add(obj)
+// Rchat: we got a text message
+func (g *Game) handleChat(pk *gnet.Packet) error {
+	chatline := pk.Data.(string)
+	io.WriteString(g.logpanel, chatline)
+	return nil
+}
+
+// Rerror: a request of ours failed
+func (g *Game) handleError(pk *gnet.Packet) error {
+	io.WriteString(g.logpanel, "error: "+pk.Data.(string))
+	return nil
+}
 
-		// Rdelobject: some object went away
-	case "Rdelobject":
-		obj := pk.Data.(game.Object)
-		g.Objects.RemoveObject(obj)
+// Rjoin: we're in the world. the map, who we control and what's around
+// us all come at once, so there's nothing to wait for.
+func (g *Game) handleJoin(pk *gnet.Packet) error {
+	join := pk.Data.(*game.Join)
 
-		// Rgetplayer: find out who we control
-	case "Rgetplayer":
-		playerid := pk.Data.(int)
+	g.Map = join.Map
 
-		pl := g.Objects.FindObjectByID(playerid)
-		if pl != nil {
+	if err := g.applySnapshot(join.Snapshot); err != nil {
+		return err
+	}
+
+	if join.PlayerID != 0 {
+		pl := g.Objects.FindObjectByID(join.PlayerID)
+		if pl == nil {
+			log.Printf("Game: handleJoin: our player %d isn't in the world", join.PlayerID)
+		} else {
 			g.pm.Lock()
 			g.player = pl
 			g.pm.Unlock()
-		} else {
-			log.Printf("Game: HandlePacket: can't find our player %s", playerid)
-
-			// just try again
-			// XXX: find a better way
-			time.AfterFunc(50*time.Millisecond, func() {
-				g.ServerWChan <- gnet.NewPacket("Tgetplayer", nil)
-			})
 		}
+	}
 
-		// Rloadmap: get the map data from the server
-	case "Rloadmap":
-		gmap := pk.Data.(*game.MapChunk)
-		g.Map = gmap
+	// after a reconnect the server has forgotten where we were looking
+	if g.spectator != nil {
+		g.spectator.Send()
+	}
 
-	default:
-		log.Printf("bad packet tag %s", pk.Tag)
+	if !g.inworld {
+		g.inworld = true
+		g.joinc <- nil
 	}
 
+	return nil
 }
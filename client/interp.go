@@ -0,0 +1,142 @@
+// Interpolation: remote objects are drawn a little in the past, moving
+// evenly between the positions the server sent instead of jumping each
+// time a snapshot arrives.
+package main
+
+import (
+	"image"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_INTERP_DELAY = 100 * time.Millisecond
+
+	// how much later than usual snapshots must keep arriving before we
+	// believe the route got slower, and how far to catch up per snapshot
+	CLOCK_SLACK = 50 * time.Millisecond
+	CLOCK_DRIFT = time.Millisecond
+)
+
+// a position and when we heard about it
+type interpSample struct {
+	t   time.Time
+	pos image.Point
+}
+
+// Interpolator buffers positions per object id
+type Interpolator struct {
+	Delay time.Duration // how far in the past we draw, 0 draws the latest
+
+	tracks map[int][]interpSample
+
+	// our time at server time 0, if synced. samples are timed by the
+	// server's clock, so network jitter doesn't make things jerk about.
+	epoch  time.Time
+	synced bool
+
+	m sync.Mutex
+}
+
+func NewInterpolator(delay time.Duration) *Interpolator {
+	return &Interpolator{Delay: delay, tracks: make(map[int][]interpSample)}
+}
+
+// Add records that id was at pos at t
+func (ip *Interpolator) Add(id int, pos image.Point, t time.Time) {
+	ip.m.Lock()
+	defer ip.m.Unlock()
+
+	track := ip.tracks[id]
+
+	// after standing still, start moving now rather than
+	// somewhere between the last move and this one
+	if n := len(track); n > 0 && track[n-1].t.Before(t.Add(-ip.Delay)) {
+		track = append(track, interpSample{t.Add(-ip.Delay), track[n-1].pos})
+	}
+
+	track = append(track, interpSample{t, pos})
+
+	// we never draw earlier than t - Delay from here on, so
+	// nothing before the sample at or before that is needed.
+	// Pos does the same, this is for objects nobody looks at.
+	for len(track) > 1 && !track[1].t.After(t.Add(-ip.Delay)) {
+		track = track[1:]
+	}
+
+	ip.tracks[id] = track
+}
+
+// ServerTime is when, by our clock, the server's state at server time
+// happened, given it arrived just now. the quickest a state has ever
+// arrived is taken as the real offset, so late ones don't count as late
+// moves. if they stay late, the offset creeps up to match.
+func (ip *Interpolator) ServerTime(server time.Duration, arrived time.Time) time.Time {
+	ip.m.Lock()
+	defer ip.m.Unlock()
+
+	if !ip.synced {
+		ip.epoch = arrived.Add(-server)
+		ip.synced = true
+	}
+
+	at := ip.epoch.Add(server)
+
+	if arrived.Before(at) {
+		ip.epoch = arrived.Add(-server)
+		at = arrived
+	} else if arrived.Sub(at) > CLOCK_SLACK {
+		ip.epoch = ip.epoch.Add(CLOCK_DRIFT)
+		at = at.Add(CLOCK_DRIFT)
+	}
+
+	return at
+}
+
+// Forget drops id's samples, or everyone's if id is -1
+func (ip *Interpolator) Forget(id int) {
+	ip.m.Lock()
+	defer ip.m.Unlock()
+
+	if id == -1 {
+		ip.tracks = make(map[int][]interpSample)
+
+		// a new connection or a jump in a replay, new clock
+		ip.synced = false
+	} else {
+		delete(ip.tracks, id)
+	}
+}
+
+// Pos returns where to draw id at now. ok is false if we know nothing about it.
+func (ip *Interpolator) Pos(id int, now time.Time) (pos image.Point, ok bool) {
+	ip.m.Lock()
+	defer ip.m.Unlock()
+
+	track := ip.tracks[id]
+	if len(track) == 0 {
+		return image.ZP, false
+	}
+
+	rt := now.Add(-ip.Delay)
+
+	// samples before the pair we're between won't be needed again
+	for len(track) > 1 && !track[1].t.After(rt) {
+		track = track[1:]
+	}
+	ip.tracks[id] = track
+
+	a := track[0]
+	if len(track) == 1 || !rt.After(a.t) {
+		return a.pos, true
+	}
+
+	b := track[1]
+	f := float64(rt.Sub(a.t)) / float64(b.t.Sub(a.t))
+
+	lerp := func(x, y int) int {
+		return x + int(float64(y-x)*f+0.5)
+	}
+
+	return image.Pt(lerp(a.pos.X, b.pos.X), lerp(a.pos.Y, b.pos.Y)), true
+}
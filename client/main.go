@@ -13,6 +13,12 @@ import (
 
 var (
 	configfile = flag.String("config", "config.lua", "configuration file")
+	username   = flag.String("username", "", "username, overriding the configuration file")
+	password   = flag.String("password", "", "password, overriding $"+PASSWORD_ENV+" and the configuration file")
+	register   = flag.Bool("register", false, "create the account instead of logging in")
+	server     = flag.String("server", "", "server address, overriding the configuration file")
+	replayfile = flag.String("replay", "", "watch the match recorded in this file instead of connecting")
+	spectate   = flag.Bool("spectate", false, "watch the game without a player")
 
 	Lua *lua.State
 )
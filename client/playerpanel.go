@@ -15,6 +15,8 @@ type PlayerPanel struct {
 	x, y int
 	name string
 
+	status string // what the replay or spectator camera is up to, if we're watching
+
 	g *Game
 }
 
@@ -27,6 +29,16 @@ func NewPlayerPanel(g *Game) *PlayerPanel {
 }
 
 func (c *PlayerPanel) Update(delta time.Duration) {
+	if c.g.replay != nil {
+		c.status = c.g.replay.String()
+		return
+	}
+
+	if c.g.spectator != nil {
+		c.status = c.g.spectator.String()
+		return
+	}
+
 	p := c.g.GetPlayer()
 	c.x, c.y = p.GetPos()
 	c.name = p.GetName()
@@ -43,6 +55,9 @@ func (c *PlayerPanel) HandleInput(ev termbox.Event) {
 func (c *PlayerPanel) Draw() {
 	c.Clear()
 	str := fmt.Sprintf("User: %s Pos: %d,%d", c.name, c.x, c.y)
+	if c.status != "" {
+		str = c.status
+	}
 	for i, r := range str {
 		c.SetCell(i, 0, r, termbox.ColorBlue, termbox.ColorDefault)
 	}
@@ -0,0 +1,124 @@
+// Prediction: our player moves as soon as a key is pressed. each snapshot
+// says which inputs the server has run, so we start again from where the
+// server put us and replay the ones it hasn't, undoing bad guesses.
+package main
+
+import (
+	"github.com/mischief/goland/game"
+	"github.com/mischief/goland/game/gnet"
+	"image"
+	"time"
+)
+
+const (
+	// how long a move may go unacked before we stop predicting it. the
+	// server drops moves it won't run, like ones over the rate limit,
+	// and nothing after them acks them. slow connections get 2*RTT.
+	PENDING_TIMEOUT = 2 * time.Second
+)
+
+// a move we predicted, and when we sent it
+type pendingInput struct {
+	*game.Input
+	sent time.Time
+}
+
+// forget inputs from an old connection, the server numbers from scratch
+func (g *Game) ResetInputs() {
+	g.pm.Lock()
+	defer g.pm.Unlock()
+
+	g.inputseq = 0
+	g.pending = nil
+	g.hasserverpos = false
+}
+
+// SendInput sends an action to the server and predicts what it does to us
+func (g *Game) SendInput(a game.Action) {
+	g.pm.Lock()
+	g.inputseq++
+	in := &game.Input{Seq: g.inputseq, Action: a}
+
+	// only movement is worth guessing
+	if _, ok := game.DirTable[a]; ok {
+		g.pending = append(g.pending, &pendingInput{in, time.Now()})
+		pos := g.predict(image.Pt(g.player.GetPos()), in)
+		g.player.SetPos(pos.X, pos.Y)
+	}
+	g.pm.Unlock()
+
+	g.SendPacket(gnet.NewPacket("Taction", in))
+}
+
+// where we think in takes us from pos. we only know about terrain,
+// so walking into things is where we get it wrong.
+func (g *Game) predict(pos image.Point, in *game.Input) image.Point {
+	offset, ok := game.DirTable[in.Action]
+	if !ok || g.Map == nil {
+		return pos
+	}
+
+	newpos := pos.Add(offset)
+	if !g.Map.CheckCollision(nil, newpos) {
+		return pos
+	}
+
+	return newpos
+}
+
+// put our player where the server has it in state, as of input ack,
+// then replay what the server hasn't seen yet
+func (g *Game) reconcile(state game.WorldState, ack uint32) {
+	g.pm.Lock()
+	defer g.pm.Unlock()
+
+	for len(g.pending) > 0 && g.pending[0].Seq <= ack {
+		g.pending = g.pending[1:]
+	}
+
+	// not in the world yet
+	id := g.player.GetID()
+	if g.Objects.FindObjectByID(id) != g.player {
+		return
+	}
+
+	st, ok := state[id]
+	if !ok {
+		return
+	}
+
+	g.serverpos, g.hasserverpos = st.Pos, true
+	g.replayPending()
+}
+
+// ExpireInputs stops predicting moves the server should have answered
+// by now. with nothing changing, no snapshot comes to tell us it dropped
+// them, so this runs every frame.
+func (g *Game) ExpireInputs() {
+	timeout := PENDING_TIMEOUT
+	if rtt := 2 * g.RTT(); rtt > timeout {
+		timeout = rtt
+	}
+
+	g.pm.Lock()
+	defer g.pm.Unlock()
+
+	n := len(g.pending)
+	for len(g.pending) > 0 && time.Since(g.pending[0].sent) > timeout {
+		g.pending = g.pending[1:]
+	}
+
+	if len(g.pending) != n && g.hasserverpos {
+		g.replayPending()
+	}
+}
+
+// move our player to serverpos plus what's pending. call with g.pm held.
+func (g *Game) replayPending() {
+	pos := g.serverpos
+	for _, in := range g.pending {
+		pos = g.predict(pos, in.Input)
+	}
+
+	g.player.SetPos(pos.X, pos.Y)
+}
@@ -0,0 +1,245 @@
+// Replay: watch a match the server recorded, without a server. The world
+// is rebuilt from the match file's frames and drawn like a live game, with
+// a camera that goes wherever you like.
+package main
+
+import (
+	"fmt"
+	"github.com/mischief/goland/game"
+	"github.com/nsf/termbox-go"
+	"image"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// how far the arrow keys seek
+	REPLAY_SEEK = 10 * time.Second
+
+	REPLAY_SPEED_MIN = 0.25
+	REPLAY_SPEED_MAX = 16
+
+	// how far a free camera moves with shift held
+	FREE_CAMERA_FAST = 10
+)
+
+var (
+	// keys that move a free camera, when watching instead of playing
+	FREE_CAMERA = map[rune]image.Point{
+		'w': game.DirTable[game.DIR_UP],
+		'k': game.DirTable[game.DIR_UP],
+		'a': game.DirTable[game.DIR_LEFT],
+		'h': game.DirTable[game.DIR_LEFT],
+		's': game.DirTable[game.DIR_DOWN],
+		'j': game.DirTable[game.DIR_DOWN],
+		'd': game.DirTable[game.DIR_RIGHT],
+		'l': game.DirTable[game.DIR_RIGHT],
+	}
+)
+
+// MatchPlayer plays a recorded match into a Game
+type MatchPlayer struct {
+	*game.Match
+
+	g *Game
+
+	pos    float64         // ticks since the start of the match
+	frame  int             // frames applied so far
+	state  game.WorldState // the world after them
+	speed  float64
+	paused bool
+	camera image.Point
+	m      sync.Mutex
+}
+
+// LoadMatch reads the match in file for watching in g
+func LoadMatch(g *Game, file string) (*MatchPlayer, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	match, err := game.ReadMatch(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	log.Printf("MatchPlayer: LoadMatch: %s: %q from %s, %d frames, %s long", file, match.Name, match.Started, len(match.Frames), match.Length())
+
+	mp := &MatchPlayer{
+		Match:  match,
+		g:      g,
+		state:  game.WorldState{},
+		speed:  1,
+		camera: image.Pt(game.MAP_WIDTH/2, game.MAP_HEIGHT/2),
+	}
+
+	return mp, nil
+}
+
+// Update moves playback along by delta, times the speed
+func (mp *MatchPlayer) Update(delta time.Duration) {
+	mp.m.Lock()
+	defer mp.m.Unlock()
+
+	if mp.paused {
+		return
+	}
+
+	mp.pos += delta.Seconds() * float64(mp.TickRate) * mp.speed
+
+	end := float64(mp.LastTick() - mp.FirstTick)
+	if mp.pos >= end {
+		mp.pos = end
+		mp.paused = true
+	}
+
+	// play what happened since, chat and all
+	for mp.frame < len(mp.Frames) && float64(mp.Frames[mp.frame].Tick-mp.FirstTick) <= mp.pos {
+		f := mp.Frames[mp.frame]
+
+		// played back at the match's own pace, so now is when it happened
+		mp.g.syncObjects(f.Deltas, time.Now())
+		mp.state = mp.state.Apply(f.Deltas)
+
+		for _, line := range f.Chat {
+			io.WriteString(mp.g.logpanel, line)
+		}
+
+		mp.frame++
+	}
+}
+
+// Seek jumps by d, back if it's negative. the world jumps along with it.
+func (mp *MatchPlayer) Seek(d time.Duration) {
+	mp.m.Lock()
+	defer mp.m.Unlock()
+
+	mp.pos += d.Seconds() * float64(mp.TickRate)
+
+	end := float64(mp.LastTick() - mp.FirstTick)
+	if mp.pos < 0 {
+		mp.pos = 0
+	} else if mp.pos > end {
+		mp.pos = end
+	}
+
+	n := mp.FramesBefore(mp.FirstTick + uint64(mp.pos))
+	target := mp.StateAt(n)
+
+	// no sliding across the map
+	mp.g.interp.Forget(-1)
+	mp.g.syncObjects(mp.state.Diff(target), time.Now())
+
+	mp.frame = n
+	mp.state = target
+
+	io.WriteString(mp.g.logpanel, fmt.Sprintf("Replay: seek to %s", mp.now()))
+}
+
+// TogglePause pauses or resumes playback. resuming at the end starts over.
+func (mp *MatchPlayer) TogglePause() {
+	mp.m.Lock()
+	end := mp.pos >= float64(mp.LastTick()-mp.FirstTick)
+	mp.paused = !mp.paused
+	mp.m.Unlock()
+
+	if !mp.Paused() && end {
+		mp.Seek(-mp.Length())
+	}
+}
+
+func (mp *MatchPlayer) Paused() bool {
+	mp.m.Lock()
+	defer mp.m.Unlock()
+
+	return mp.paused
+}
+
+// SetSpeed multiplies the playback speed by f
+func (mp *MatchPlayer) SetSpeed(f float64) {
+	mp.m.Lock()
+	defer mp.m.Unlock()
+
+	mp.speed *= f
+	if mp.speed < REPLAY_SPEED_MIN {
+		mp.speed = REPLAY_SPEED_MIN
+	} else if mp.speed > REPLAY_SPEED_MAX {
+		mp.speed = REPLAY_SPEED_MAX
+	}
+}
+
+// MoveCamera moves the camera by off
+func (mp *MatchPlayer) MoveCamera(off image.Point) {
+	mp.m.Lock()
+	defer mp.m.Unlock()
+
+	mp.camera = mp.camera.Add(off)
+}
+
+// Camera is where the camera is looking
+func (mp *MatchPlayer) Camera() image.Point {
+	mp.m.Lock()
+	defer mp.m.Unlock()
+
+	return mp.camera
+}
+
+// how far into the match we are. call with mp.m held.
+func (mp *MatchPlayer) now() time.Duration {
+	return time.Duration(mp.pos * float64(time.Second) / float64(mp.TickRate))
+}
+
+func (mp *MatchPlayer) String() string {
+	mp.m.Lock()
+	defer mp.m.Unlock()
+
+	s := fmt.Sprintf("Replay: %s %s/%s %gx Cam: %d,%d", mp.Name, mp.now()/time.Second*time.Second, mp.Length()/time.Second*time.Second, mp.speed, mp.camera.X, mp.camera.Y)
+	if mp.paused {
+		s += " paused"
+	}
+
+	return s
+}
+
+// StartReplay sets g up to watch the match in file instead of playing
+func (g *Game) StartReplay(file string) error {
+	mp, err := LoadMatch(g, file)
+	if err != nil {
+		return err
+	}
+
+	g.replay = mp
+	g.Map = mp.Map
+
+	return nil
+}
+
+// set up the keys for watching a replay. Only called from Start.
+func (g *Game) replayKeys() {
+	mp := g.replay
+
+	g.HandleRune(' ', func(_ termbox.Event) { mp.TogglePause() })
+	g.HandleRune('+', func(_ termbox.Event) { mp.SetSpeed(2) })
+	g.HandleRune('=', func(_ termbox.Event) { mp.SetSpeed(2) })
+	g.HandleRune('-', func(_ termbox.Event) { mp.SetSpeed(0.5) })
+	g.HandleKey(termbox.KeyArrowLeft, func(_ termbox.Event) { mp.Seek(-REPLAY_SEEK) })
+	g.HandleKey(termbox.KeyArrowRight, func(_ termbox.Event) { mp.Seek(REPLAY_SEEK) })
+	g.HandleKey(termbox.KeyHome, func(_ termbox.Event) { mp.Seek(-mp.Length()) })
+
+	g.freeCameraKeys(mp.MoveCamera)
+}
+
+// bind FREE_CAMERA to move, with shift moving further
+func (g *Game) freeCameraKeys(move func(off image.Point)) {
+	for k, v := range FREE_CAMERA {
+		func(c rune, off image.Point) {
+			g.HandleRune(c, func(_ termbox.Event) { move(off) })
+			g.HandleRune(c-'a'+'A', func(_ termbox.Event) { move(off.Mul(FREE_CAMERA_FAST)) })
+		}(k, v)
+	}
+}
@@ -0,0 +1,88 @@
+// Snapshot handling: rebuild the world from the server's deltas and
+// acknowledge each state so the server can diff against it.
+package main
+
+import (
+	"github.com/mischief/goland/game"
+	"github.com/mischief/goland/game/gnet"
+	"log"
+	"time"
+)
+
+// forget every state we had. the server starts a new connection
+// from the empty world, state 0.
+func (g *Game) ResetSnapshots() {
+	g.snaps.Reset()
+
+	g.interp.Forget(-1)
+}
+
+// Rsnapshot: the world changed
+func (g *Game) handleSnapshot(pk *gnet.Packet) error {
+	return g.applySnapshot(pk.Data.(*game.Snapshot))
+}
+
+// bring the world up to snap and ack it
+func (g *Game) applySnapshot(snap *game.Snapshot) error {
+	deltas, ok, err := g.snaps.Apply(snap)
+	if !ok {
+		return err
+	}
+
+	g.syncObjects(deltas, g.interp.ServerTime(snap.Time, time.Now()))
+	g.reconcile(g.snaps.Current(), snap.InputAck)
+
+	g.cm.Lock()
+	c := g.ServerCon
+	g.cm.Unlock()
+
+	// a join that failed during a reconnect, nobody to ack to
+	if c == nil {
+		return nil
+	}
+
+	// not through SendPacket, acks would flood the log
+	if err := c.WritePacket(gnet.NewPacket("Tack", snap.Seq)); err != nil {
+		log.Printf("Game: applySnapshot: %s", err)
+	}
+
+	return nil
+}
+
+// make Objects match the world after deltas, which happened at at
+func (g *Game) syncObjects(deltas []*game.ObjectDelta, at time.Time) {
+	for _, d := range deltas {
+		o := g.Objects.FindObjectByID(d.ID)
+
+		if d.Fields&game.DELTA_REMOVED != 0 {
+			if o != nil {
+				g.Objects.RemoveObject(o)
+			}
+			g.interp.Forget(d.ID)
+			continue
+		}
+
+		if o == nil {
+			o = game.NewGameObject(d.Name)
+			o.SetID(d.ID)
+			g.Objects.Add(o)
+		} else if d.Fields&game.DELTA_NAME != 0 {
+			o.SetName(d.Name)
+		}
+
+		if d.Fields&game.DELTA_POS != 0 {
+			o.SetPos(d.Pos.X, d.Pos.Y)
+			g.interp.Add(d.ID, d.Pos, at)
+		}
+
+		if d.Fields&game.DELTA_GLYPH != 0 {
+			o.SetGlyph(d.Glyph)
+		}
+
+		for tag, val := range d.Tags {
+			o.SetTag(tag, val)
+		}
+
+		o.SetTag("visible", d.Visible)
+	}
+}
@@ -0,0 +1,146 @@
+// Spectating: with -spectate we join without a player and watch. The
+// camera follows any player, cycling through them, or moves freely, and
+// the server is told where it is so it sends us what's there.
+package main
+
+import (
+	"fmt"
+	"github.com/mischief/goland/game"
+	"github.com/mischief/goland/game/gnet"
+	"github.com/nsf/termbox-go"
+	"image"
+	"sort"
+	"sync"
+)
+
+// Spectator is our camera when watching a live game
+type Spectator struct {
+	g *Game
+
+	cam game.Camera
+	m   sync.Mutex
+}
+
+func NewSpectator(g *Game) *Spectator {
+	return &Spectator{g: g, cam: game.Camera{Pos: image.Pt(game.MAP_WIDTH/2, game.MAP_HEIGHT/2)}}
+}
+
+// the players we know about, by id
+func (s *Spectator) players() []game.Object {
+	var players []game.Object
+	for o := range s.g.Objects.Chan() {
+		if o.GetTag("player") {
+			players = append(players, o)
+		}
+	}
+
+	sort.Sort(byID(players))
+	return players
+}
+
+type byID []game.Object
+
+func (b byID) Len() int           { return len(b) }
+func (b byID) Less(i, j int) bool { return b[i].GetID() < b[j].GetID() }
+func (b byID) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// the object we're following, or nil. call with s.m held.
+func (s *Spectator) followed() game.Object {
+	if s.cam.Follow == 0 {
+		return nil
+	}
+
+	return s.g.Objects.FindObjectByID(s.cam.Follow)
+}
+
+// Center is where to point the view
+func (s *Spectator) Center() image.Point {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if o := s.followed(); o != nil {
+		return s.g.RenderPos(o)
+	}
+
+	return s.cam.Pos
+}
+
+// Cycle follows the player step places after the one we follow now
+func (s *Spectator) Cycle(step int) {
+	players := s.players()
+	if len(players) == 0 {
+		s.g.logpanel.Write([]byte("Nobody to follow."))
+		return
+	}
+
+	s.m.Lock()
+
+	cur := -1
+	for i, p := range players {
+		if p.GetID() == s.cam.Follow {
+			cur = i
+		}
+	}
+
+	if cur == -1 && step < 0 {
+		cur = 0
+	}
+
+	next := players[((cur+step)%len(players)+len(players))%len(players)]
+
+	s.cam.Follow = next.GetID()
+	s.cam.Pos = image.Pt(next.GetPos())
+
+	s.m.Unlock()
+
+	s.g.logpanel.Write([]byte(fmt.Sprintf("Following %s.", next.GetName())))
+	s.Send()
+}
+
+// Move stops following and moves the camera by off
+func (s *Spectator) Move(off image.Point) {
+	s.m.Lock()
+
+	if o := s.followed(); o != nil {
+		s.cam.Pos = image.Pt(o.GetPos())
+	}
+
+	s.cam.Follow = 0
+	s.cam.Pos = s.cam.Pos.Add(off)
+
+	s.m.Unlock()
+
+	s.Send()
+}
+
+// Send tells the server where we're looking
+func (s *Spectator) Send() {
+	s.m.Lock()
+	cam := s.cam
+	s.m.Unlock()
+
+	s.g.SendPacket(gnet.NewPacket("Tcamera", &cam))
+}
+
+func (s *Spectator) String() string {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if o := s.followed(); o != nil {
+		return fmt.Sprintf("Spectating: following %s", o.GetName())
+	}
+
+	return fmt.Sprintf("Spectating: free camera at %d,%d", s.cam.Pos.X, s.cam.Pos.Y)
+}
+
+// set up the keys for spectating. Only called from Start.
+func (g *Game) spectatorKeys() {
+	s := g.spectator
+
+	g.HandleKey(termbox.KeyTab, func(_ termbox.Event) { s.Cycle(1) })
+	g.HandleRune('n', func(_ termbox.Event) { s.Cycle(1) })
+	g.HandleRune('p', func(_ termbox.Event) { s.Cycle(-1) })
+	g.HandleRune('f', func(_ termbox.Event) { s.Move(image.ZP) })
+
+	g.freeCameraKeys(s.Move)
+}
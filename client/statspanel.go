@@ -21,10 +21,13 @@ type StatsPanel struct {
 	memstats runtime.MemStats
 
 	fps float64
+	rtt time.Duration
+
+	g *Game
 }
 
-func NewStatsPanel() *StatsPanel {
-	sp := &StatsPanel{}
+func NewStatsPanel(g *Game) *StatsPanel {
+	sp := &StatsPanel{g: g}
 
 	sp.HandleInput(termbox.Event{Type: termbox.EventResize})
 
@@ -32,11 +35,12 @@ func NewStatsPanel() *StatsPanel {
 }
 
 func (s StatsPanel) String() string {
-	return fmt.Sprintf("%5.2f FPS %5.2f MB %d GC %d GR", s.fps, float64(s.memstats.HeapAlloc)/1000000.0, s.memstats.NumGC, runtime.NumGoroutine())
+	return fmt.Sprintf("%5.2f FPS %5.2f MB %d GC %d GR %4dms RTT", s.fps, float64(s.memstats.HeapAlloc)/1000000.0, s.memstats.NumGC, runtime.NumGoroutine(), s.rtt/time.Millisecond)
 }
 
 func (s *StatsPanel) Update(delta time.Duration) {
 	runtime.ReadMemStats(&s.memstats)
+	s.rtt = s.g.RTT()
 
 	s.samples[s.current%FPS_SAMPLES] = 1.0 / delta.Seconds()
 	s.current++
@@ -35,7 +35,11 @@ func NewViewPanel(g *Game) *ViewPanel {
 func (vp *ViewPanel) Update(delta time.Duration) {
 	// should set camera center
 	p := vp.g.GetPlayer()
-	if p != nil {
+	if vp.g.replay != nil {
+		vp.cam.SetCenter(vp.g.replay.Camera())
+	} else if vp.g.spectator != nil {
+		vp.cam.SetCenter(vp.g.spectator.Center())
+	} else if p != nil {
 		vp.cam.SetCenter(image.Pt(p.GetPos()))
 	} else {
 		vp.cam.SetCenter(image.Pt(256/2, 256/2))
@@ -71,9 +75,9 @@ func (vp *ViewPanel) Draw() {
 		}
 	}
 
-	for o := range vp.g.Objects.Chan() {
+	for _, o := range vp.g.Objects.ObjectsInRect(vp.cam.Rect) {
 		if o.GetTag("visible") {
-			realpos := vp.cam.Transform(image.Pt(o.GetPos()))
+			realpos := vp.cam.Transform(vp.g.RenderPos(o))
 			g := o.GetGlyph()
 			vp.SetCell(realpos.X, realpos.Y, g.Ch, g.Fg, g.Bg)
 		}
@@ -0,0 +1,445 @@
+// Bot: a goland client with no terminal, for AI opponents, integration
+// tests and load tests. A Bot logs in, keeps its own copy of the world it
+// can see, acks snapshots and pings like the real client, and tells you
+// what happened on its Events channel.
+//
+//	b, err := bot.Dial(&bot.Config{Server: "127.0.0.1:61507", Username: "bot1", Password: "hunter2", Register: true})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer b.Close()
+//
+//	b.Move(game.DIR_UP)
+//	for ev := range b.Events() {
+//		log.Print(ev)
+//	}
+package bot
+
+import (
+	"fmt"
+	"github.com/mischief/goland/game"
+	"github.com/mischief/goland/game/gnet"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	BOT_NAME    = "goland-bot"
+	BOT_VERSION = "0.1"
+
+	// how long to wait for each step of getting into the world
+	HANDSHAKE_TIMEOUT = 10 * time.Second
+
+	// how often we ping, and how long the server may stay silent
+	PING_INTERVAL  = 2 * time.Second
+	SERVER_TIMEOUT = 10 * time.Second
+
+	// events waiting for the reader before new ones are dropped
+	EVENT_BUFFER = 256
+)
+
+// Config says where a Bot connects and who it is
+type Config struct {
+	Server   string // address of the server
+	Username string
+	Password string
+	Register bool   // create the account instead of logging in to it
+	Codec    string // codec to ask for, "" for the server's choice
+	Spectate bool   // watch without a player
+
+	Name    string // client name in our hello, BOT_NAME if empty
+	Version string // client version in our hello, BOT_VERSION if empty
+}
+
+type EventKind int
+
+const (
+	EVENT_JOIN       EventKind = iota // we're in the world
+	EVENT_WORLD                       // objects changed, see Deltas
+	EVENT_CHAT                        // Text is something we were told
+	EVENT_ERROR                       // Text is why a request of ours failed
+	EVENT_BYE                         // the server is hanging up, Text says why
+	EVENT_DISCONNECT                  // the connection is gone, Err says why
+)
+
+var eventKinds = map[EventKind]string{
+	EVENT_JOIN:       "join",
+	EVENT_WORLD:      "world",
+	EVENT_CHAT:       "chat",
+	EVENT_ERROR:      "error",
+	EVENT_BYE:        "bye",
+	EVENT_DISCONNECT: "disconnect",
+}
+
+func (k EventKind) String() string {
+	if s, ok := eventKinds[k]; ok {
+		return s
+	}
+
+	return fmt.Sprintf("event %d", int(k))
+}
+
+// Event is something that happened to a Bot
+type Event struct {
+	Kind   EventKind
+	Text   string
+	Deltas []*game.ObjectDelta // for EVENT_JOIN and EVENT_WORLD, how the world changed
+	Err    error
+	Packet *gnet.Packet // what the server sent, nil for EVENT_DISCONNECT
+}
+
+func (ev Event) String() string {
+	switch ev.Kind {
+	case EVENT_JOIN, EVENT_WORLD:
+		return fmt.Sprintf("(%s %d deltas)", ev.Kind, len(ev.Deltas))
+	case EVENT_DISCONNECT:
+		return fmt.Sprintf("(%s %v)", ev.Kind, ev.Err)
+	}
+
+	return fmt.Sprintf("(%s %s)", ev.Kind, ev.Text)
+}
+
+// Bot is one connection to a server
+type Bot struct {
+	config Config
+
+	conn       *gnet.Conn
+	dispatcher *gnet.Dispatcher
+
+	events chan *Event
+	joinc  chan error    // Dial waits here for Rjoin
+	done   chan struct{} // closed when the reader stops
+
+	m        sync.Mutex // protects everything below
+	joined   bool
+	mapchunk *game.MapChunk
+	playerID int
+	snaps    *game.SnapshotTracker // states we acked
+	inputseq uint32                // Seq of our last Taction
+	inputack uint32                // last one the server ran
+	rtt      time.Duration
+	pingseq  uint32
+	dropped  int   // events nobody read in time
+	err      error // why we're disconnected
+}
+
+// Dial connects to the server in config, logs in and waits until we're
+// in the world
+func Dial(config *Config) (*Bot, error) {
+	nc, err := net.DialTimeout("tcp", config.Server, HANDSHAKE_TIMEOUT)
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to %s: %s", config.Server, err)
+	}
+
+	return DialConn(nc, config)
+}
+
+// DialConn is Dial over a connection we already have, like one end of a
+// net.Pipe to a server in the same process. config.Server isn't used.
+// nc is closed if we can't get into the world.
+func DialConn(nc net.Conn, config *Config) (*Bot, error) {
+	b := &Bot{
+		config: *config,
+		events: make(chan *Event, EVENT_BUFFER),
+		joinc:  make(chan error, 1),
+		done:   make(chan struct{}),
+		snaps:  game.NewSnapshotTracker(),
+	}
+
+	if b.config.Name == "" {
+		b.config.Name = BOT_NAME
+	}
+
+	if b.config.Version == "" {
+		b.config.Version = BOT_VERSION
+	}
+
+	b.setupHandlers()
+
+	// everyone starts out in the default codec; the handshake may switch us
+	codec, _ := gnet.GetCodec(gnet.DEFAULT_CODEC)
+	b.conn = gnet.NewConn(nc, codec)
+
+	if err := b.handshake(); err != nil {
+		b.conn.Close()
+		return nil, err
+	}
+
+	go b.reader()
+
+	// the server answers our login with the map, our player and
+	// everything we can see, all in one Rjoin
+	var err error
+	select {
+	case err = <-b.joinc:
+	case <-time.After(HANDSHAKE_TIMEOUT):
+		err = fmt.Errorf("server didn't let us join the world")
+	}
+
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	go b.pinger()
+
+	return b, nil
+}
+
+// say hello and log in. Nothing else may be sent or read until this returns.
+func (b *Bot) handshake() error {
+	hello := gnet.NewHello(b.config.Name, b.config.Version, b.config.Username, "ping")
+	if b.config.Codec != "" {
+		hello.Codecs = []string{b.config.Codec}
+	}
+
+	if b.config.Spectate {
+		hello.Features = append(hello.Features, "spectate")
+	}
+
+	w, err := gnet.ClientHello(b.conn, hello, HANDSHAKE_TIMEOUT)
+	if err != nil {
+		return err
+	}
+
+	// without it, we'd get a player
+	if b.config.Spectate && !gnet.HasFeature(w.Features, "spectate") {
+		return fmt.Errorf("server doesn't allow spectators")
+	}
+
+	login := &gnet.Login{Password: b.config.Password, Register: b.config.Register}
+	_, err = gnet.ClientLogin(b.conn, login, HANDSHAKE_TIMEOUT)
+
+	return err
+}
+
+// read packets from the server until it goes away
+func (b *Bot) reader() {
+	defer close(b.done)
+
+	var err error
+	for {
+		// the server answers our pings, so silence means it's gone
+		b.conn.SetReadDeadline(time.Now().Add(SERVER_TIMEOUT))
+
+		var p *gnet.Packet
+		if p, err = b.conn.ReadPacket(); err != nil {
+			break
+		}
+
+		if err := b.dispatcher.Dispatch(p); err != nil {
+			log.Printf("Bot: %s: reader: %s", b.config.Username, err)
+		}
+	}
+
+	b.m.Lock()
+	if b.err == nil {
+		b.err = err
+	}
+	err = b.err
+	joined := b.joined
+	b.m.Unlock()
+
+	// Dial is still waiting, let it deal with this
+	if !joined {
+		b.joinc <- fmt.Errorf("disconnected before joining the world: %s", err)
+	}
+
+	b.emit(&Event{Kind: EVENT_DISCONNECT, Err: err})
+	close(b.events)
+}
+
+// send a Tping every PING_INTERVAL until the reader stops
+func (b *Bot) pinger() {
+	t := time.NewTicker(PING_INTERVAL)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-b.done:
+			return
+		}
+
+		b.m.Lock()
+		b.pingseq++
+		ping := gnet.NewPing(b.pingseq, b.rtt)
+		b.m.Unlock()
+
+		if err := b.conn.WritePacket(gnet.NewPacket("Tping", ping)); err != nil {
+			return
+		}
+	}
+}
+
+// queue ev for Events, dropping it if nobody is keeping up
+func (b *Bot) emit(ev *Event) {
+	select {
+	case b.events <- ev:
+	default:
+		b.m.Lock()
+		b.dropped++
+		b.m.Unlock()
+	}
+}
+
+// Events is what happens to us, in order. It's closed after the
+// EVENT_DISCONNECT. Events that nobody reads in time are dropped, so a
+// bot that doesn't care can ignore them.
+func (b *Bot) Events() <-chan *Event {
+	return b.events
+}
+
+// Dropped is how many events were dropped because nobody read them
+func (b *Bot) Dropped() int {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	return b.dropped
+}
+
+// Err is why we were disconnected, nil while we're connected
+func (b *Bot) Err() error {
+	select {
+	case <-b.done:
+	default:
+		return nil
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	return b.err
+}
+
+// Done is closed once we're disconnected
+func (b *Bot) Done() <-chan struct{} {
+	return b.done
+}
+
+// Close hangs up and waits for the reader to notice
+func (b *Bot) Close() error {
+	b.m.Lock()
+	if b.err == nil {
+		b.err = fmt.Errorf("closed")
+	}
+	b.m.Unlock()
+
+	err := b.conn.Close()
+	<-b.done
+
+	return err
+}
+
+// RTT is the last measured round trip time to the server
+func (b *Bot) RTT() time.Duration {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	return b.rtt
+}
+
+// Send sends pk to the server as it is
+func (b *Bot) Send(pk *gnet.Packet) error {
+	if err := gnet.Validate(pk, gnet.CLIENT_TO_SERVER); err != nil {
+		return err
+	}
+
+	return b.conn.WritePacket(pk)
+}
+
+// Act asks the server to do a to our player. The server runs actions in
+// order, and InputAck catches up with the returned seq once it has run it.
+func (b *Bot) Act(a game.Action) (uint32, error) {
+	b.m.Lock()
+	b.inputseq++
+	in := &game.Input{Seq: b.inputseq, Action: a}
+	b.m.Unlock()
+
+	return in.Seq, b.Send(gnet.NewPacket("Taction", in))
+}
+
+// Move takes a step in dir, one of the DIR_ actions
+func (b *Bot) Move(dir game.Action) (uint32, error) {
+	if _, ok := game.DirTable[dir]; !ok {
+		return 0, fmt.Errorf("%d isn't a direction", int(dir))
+	}
+
+	return b.Act(dir)
+}
+
+// Pickup picks up what's where we stand
+func (b *Bot) Pickup() (uint32, error) {
+	return b.Act(game.ACTION_ITEM_PICKUP)
+}
+
+// Drop drops everything we carry
+func (b *Bot) Drop() (uint32, error) {
+	return b.Act(game.ACTION_ITEM_DROP)
+}
+
+// Inventory asks the server what we carry; it answers in chat
+func (b *Bot) Inventory() (uint32, error) {
+	return b.Act(game.ACTION_ITEM_LIST_INVENTORY)
+}
+
+// Chat says line to everyone
+func (b *Bot) Chat(line string) error {
+	return b.Send(gnet.NewPacket("Tchat", line))
+}
+
+// Look points a spectator's camera somewhere else
+func (b *Bot) Look(cam game.Camera) error {
+	return b.Send(gnet.NewPacket("Tcamera", &cam))
+}
+
+// InputAck is the seq of the last action the server ran for us
+func (b *Bot) InputAck() uint32 {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	return b.inputack
+}
+
+// register our handlers for server packets
+func (b *Bot) setupHandlers() {
+	b.dispatcher = gnet.NewDispatcher(gnet.SERVER_TO_CLIENT)
+
+	b.dispatcher.Handle("Rjoin", b.handleJoin)
+	b.dispatcher.Handle("Rsnapshot", b.handleSnapshot)
+	b.dispatcher.Handle("Rchat", b.handleText(EVENT_CHAT))
+	b.dispatcher.Handle("Rerror", b.handleText(EVENT_ERROR))
+	b.dispatcher.Handle("Rbye", b.handleBye)
+	b.dispatcher.Handle("Rpong", b.handlePong)
+}
+
+// Rchat and Rerror: pass the text along
+func (b *Bot) handleText(kind EventKind) gnet.Handler {
+	return func(pk *gnet.Packet) error {
+		b.emit(&Event{Kind: kind, Text: pk.Data.(string), Packet: pk})
+		return nil
+	}
+}
+
+// Rbye: the server is hanging up on purpose
+func (b *Bot) handleBye(pk *gnet.Packet) error {
+	b.m.Lock()
+	b.err = fmt.Errorf("server said bye: %s", pk.Data)
+	b.m.Unlock()
+
+	b.emit(&Event{Kind: EVENT_BYE, Text: pk.Data.(string), Packet: pk})
+	return nil
+}
+
+// Rpong: our ping came back
+func (b *Bot) handlePong(pk *gnet.Packet) error {
+	ping := pk.Data.(*gnet.Ping)
+
+	b.m.Lock()
+	b.rtt = ping.Since()
+	b.m.Unlock()
+
+	return nil
+}
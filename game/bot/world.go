@@ -0,0 +1,133 @@
+// World: our copy of what the server lets us see, rebuilt from its
+// snapshots. WorldStates are never changed once made, so the ones handed
+// out here are safe to keep and read while the world moves on.
+package bot
+
+import (
+	"github.com/mischief/goland/game"
+	"github.com/mischief/goland/game/gnet"
+	"image"
+)
+
+// Rjoin: we're in the world
+func (b *Bot) handleJoin(pk *gnet.Packet) error {
+	join := pk.Data.(*game.Join)
+
+	b.m.Lock()
+	b.mapchunk = join.Map
+	b.playerID = join.PlayerID
+	b.m.Unlock()
+
+	deltas, err := b.applySnapshot(join.Snapshot)
+	if err != nil {
+		return err
+	}
+
+	b.m.Lock()
+	joined := b.joined
+	b.joined = true
+	b.m.Unlock()
+
+	if !joined {
+		b.joinc <- nil
+	}
+
+	b.emit(&Event{Kind: EVENT_JOIN, Deltas: deltas, Packet: pk})
+	return nil
+}
+
+// Rsnapshot: the world changed
+func (b *Bot) handleSnapshot(pk *gnet.Packet) error {
+	deltas, err := b.applySnapshot(pk.Data.(*game.Snapshot))
+	if err != nil {
+		return err
+	}
+
+	if len(deltas) > 0 {
+		b.emit(&Event{Kind: EVENT_WORLD, Deltas: deltas, Packet: pk})
+	}
+
+	return nil
+}
+
+// bring the world up to snap and ack it. returns what changed.
+func (b *Bot) applySnapshot(snap *game.Snapshot) ([]*game.ObjectDelta, error) {
+	b.m.Lock()
+
+	deltas, ok, err := b.snaps.Apply(snap)
+	if !ok {
+		b.m.Unlock()
+		return nil, err
+	}
+
+	if snap.InputAck > b.inputack {
+		b.inputack = snap.InputAck
+	}
+
+	b.m.Unlock()
+
+	if err := b.conn.WritePacket(gnet.NewPacket("Tack", snap.Seq)); err != nil {
+		return deltas, err
+	}
+
+	return deltas, nil
+}
+
+// World is every object we can see, by id. Don't change it.
+func (b *Bot) World() game.WorldState {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	return b.snaps.Current()
+}
+
+// Map is the world's terrain
+func (b *Bot) Map() *game.MapChunk {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	return b.mapchunk
+}
+
+// PlayerID is the id of the object we control, 0 for spectators
+func (b *Bot) PlayerID() int {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	return b.playerID
+}
+
+// Player is our player as of the last snapshot
+func (b *Bot) Player() (*game.ObjectState, bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.playerID == 0 {
+		return nil, false
+	}
+
+	st, ok := b.snaps.Current()[b.playerID]
+	return st, ok
+}
+
+// Find is the objects we can see that match
+func (b *Bot) Find(match func(id int, st *game.ObjectState) bool) game.WorldState {
+	found := game.WorldState{}
+	for id, st := range b.World() {
+		if match(id, st) {
+			found[id] = st
+		}
+	}
+
+	return found
+}
+
+// At is the objects we can see at pt
+func (b *Bot) At(pt image.Point) game.WorldState {
+	return b.Find(func(_ int, st *game.ObjectState) bool { return st.Pos == pt })
+}
+
+// Tagged is the objects we can see with tag set
+func (b *Bot) Tagged(tag string) game.WorldState {
+	return b.Find(func(_ int, st *game.ObjectState) bool { return st.Tags[tag] })
+}
@@ -4,6 +4,7 @@ package game
 import (
 	"bytes"
 	"encoding/gob"
+	"encoding/json"
 	"fmt"
 	"github.com/nsf/termbox-go"
 	"github.com/nsf/tulib"
@@ -14,24 +15,9 @@ import (
 	"time"
 )
 
-var (
-	idchan chan int
-)
-
 func init() {
 	gob.Register(&GameObject{})
 	gob.Register(&GameObjectMap{})
-
-	idchan = make(chan int)
-
-	go func() {
-		var id int
-		id = 0
-		for {
-			id++
-			idchan <- id
-		}
-	}()
 }
 
 // TODO: remove need for this when drawing terrain with camera.Draw
@@ -40,6 +26,11 @@ type Renderable interface {
 	Draw(buf *tulib.Buffer, pos image.Point)
 }
 
+// PosWatcher is told when an object it watches moves
+type PosWatcher interface {
+	ObjectMoved(o Object)
+}
+
 type Object interface {
 	// Setter/getter for ID
 	SetID(id int)
@@ -64,6 +55,14 @@ type Object interface {
 	AddSubObject(obj Object)
 	RemoveSubObject(obj Object) Object
 
+	// changed since the flag was last cleared
+	SetDirty(dirty bool)
+	IsDirty() bool
+
+	// watchers are told after the object moves
+	AddPosWatcher(w PosWatcher)
+	RemovePosWatcher(w PosWatcher)
+
 	// update this object with delta
 	Update(delta time.Duration)
 
@@ -79,12 +78,14 @@ type GameObject struct {
 	Tags       map[string]bool // object tags
 	SubObjects *GameObjectMap  // objects associated with this one
 
-	m sync.Mutex // lock, ew
+	dirty    bool         // changed since the server last sent it
+	watchers []PosWatcher // told when we move, see SetPos
+	m        sync.Mutex   // lock, ew
 }
 
 func NewGameObject(name string) Object {
 	gob := &GameObject{
-		ID:         <-idchan,
+		ID:         IDs.Next(),
 		ItemID:     -1,
 		Name:       name,
 		Pos:        image.ZP,
@@ -129,6 +130,7 @@ func (gob *GameObject) SetName(name string) {
 	defer gob.m.Unlock()
 
 	gob.Name = name
+	gob.dirty = true
 }
 
 func (gob *GameObject) GetName() string {
@@ -140,10 +142,25 @@ func (gob *GameObject) GetName() string {
 
 func (gob *GameObject) SetPos(x, y int) bool {
 	gob.m.Lock()
-	defer gob.m.Unlock()
+
+	moved := gob.Pos.X != x || gob.Pos.Y != y
+	if moved {
+		gob.dirty = true
+	}
 
 	gob.Pos.X = x
 	gob.Pos.Y = y
+
+	watchers := gob.watchers
+	gob.m.Unlock()
+
+	// not holding our lock, watchers will want to look at us
+	if moved {
+		for _, w := range watchers {
+			w.ObjectMoved(gob)
+		}
+	}
+
 	return true
 }
 
@@ -159,6 +176,7 @@ func (gob *GameObject) SetGlyph(glyph termbox.Cell) {
 	defer gob.m.Unlock()
 
 	gob.Glyph = glyph
+	gob.dirty = true
 }
 
 func (gob *GameObject) GetGlyph() termbox.Cell {
@@ -174,6 +192,10 @@ func (gob *GameObject) SetTag(tag string, val bool) (old bool) {
 
 	old = gob.Tags[tag]
 	gob.Tags[tag] = val
+
+	if old != val {
+		gob.dirty = true
+	}
 	return
 }
 
@@ -193,13 +215,88 @@ func (gob *GameObject) GetSubObjects() *GameObjectMap {
 
 func (gob *GameObject) AddSubObject(obj Object) {
 	gob.SubObjects.Add(obj)
+	gob.SetDirty(true)
 }
 
 func (gob *GameObject) RemoveSubObject(obj Object) Object {
 	gob.SubObjects.RemoveObject(obj)
+	gob.SetDirty(true)
 	return obj
 }
 
+func (gob *GameObject) SetDirty(dirty bool) {
+	gob.m.Lock()
+	defer gob.m.Unlock()
+
+	gob.dirty = dirty
+}
+
+func (gob *GameObject) IsDirty() bool {
+	gob.m.Lock()
+	defer gob.m.Unlock()
+
+	return gob.dirty
+}
+
+// adding a watcher twice does nothing
+func (gob *GameObject) AddPosWatcher(w PosWatcher) {
+	gob.m.Lock()
+	defer gob.m.Unlock()
+
+	for _, ow := range gob.watchers {
+		if ow == w {
+			return
+		}
+	}
+
+	gob.watchers = append(gob.watchers, w)
+}
+
+func (gob *GameObject) RemovePosWatcher(w PosWatcher) {
+	gob.m.Lock()
+	defer gob.m.Unlock()
+
+	// SetPos may be going through the old slice, so make a new one
+	var watchers []PosWatcher
+	for _, ow := range gob.watchers {
+		if ow != w {
+			watchers = append(watchers, ow)
+		}
+	}
+
+	gob.watchers = watchers
+}
+
+// Copy returns a snapshot of gob that can be read while gob keeps changing.
+// sub objects are shared with gob, only the map holding them is copied.
+func (gob *GameObject) Copy() *GameObject {
+	gob.m.Lock()
+	defer gob.m.Unlock()
+
+	tags := make(map[string]bool, len(gob.Tags))
+	for k, v := range gob.Tags {
+		tags[k] = v
+	}
+
+	// not Add, the copy mustn't watch the originals
+	subs := NewGameObjectMap()
+	if gob.SubObjects != nil {
+		for o := range gob.SubObjects.Chan() {
+			subs.Objs[o.GetID()] = o
+		}
+	}
+
+	return &GameObject{
+		ID:         gob.ID,
+		ItemID:     gob.ItemID,
+		Name:       gob.Name,
+		Pos:        gob.Pos,
+		Glyph:      gob.Glyph,
+		Tags:       tags,
+		SubObjects: subs,
+	}
+}
+
 func (gob *GameObject) Update(delta time.Duration) {
 }
 
@@ -207,11 +304,13 @@ func (gob *GameObject) Draw(buf *tulib.Buffer, pos image.Point) {
 	buf.Set(pos.X, pos.Y, gob.Glyph)
 }
 
-// handy interface for a collection of game objects
+// handy interface for a collection of game objects,
+// indexed by position for the Objects* and Nearest queries
 type GameObjectMap struct {
 	Objs map[int]Object
 
-	m sync.Mutex
+	grid *SpatialGrid // built on first use, see index
+	m    sync.Mutex
 }
 
 func NewGameObjectMap() *GameObjectMap {
@@ -219,19 +318,116 @@ func NewGameObjectMap() *GameObjectMap {
 	return &g
 }
 
+// the position index, built from Objs if we don't have one yet,
+// which is the case for maps that came off the wire. caller holds gom.m.
+func (gom *GameObjectMap) index() *SpatialGrid {
+	if gom.grid == nil {
+		gom.grid = NewSpatialGrid(DEFAULT_GRID_CELL)
+		for id, o := range gom.Objs {
+			gom.grid.Set(id, image.Pt(o.GetPos()))
+			o.AddPosWatcher(gom)
+		}
+	}
+
+	return gom.grid
+}
+
 func (gom *GameObjectMap) Add(obj Object) {
 	// make sure we don't double insert
 	gom.m.Lock()
-	if _, ok := gom.Objs[obj.GetID()]; !ok {
-		gom.Objs[obj.GetID()] = obj
+	defer gom.m.Unlock()
+
+	id := obj.GetID()
+	if _, ok := gom.Objs[id]; !ok {
+		gom.Objs[id] = obj
+		gom.index().Set(id, image.Pt(obj.GetPos()))
+		obj.AddPosWatcher(gom)
 	}
-	gom.m.Unlock()
 }
 
 func (gom *GameObjectMap) RemoveObject(obj Object) {
 	gom.m.Lock()
-	delete(gom.Objs, obj.GetID())
-	gom.m.Unlock()
+	defer gom.m.Unlock()
+
+	id := obj.GetID()
+	if o, ok := gom.Objs[id]; ok {
+		o.RemovePosWatcher(gom)
+		delete(gom.Objs, id)
+		gom.index().Remove(id)
+	}
+}
+
+// ObjectMoved keeps the index up to date, see PosWatcher
+func (gom *GameObjectMap) ObjectMoved(obj Object) {
+	gom.m.Lock()
+	defer gom.m.Unlock()
+
+	id := obj.GetID()
+	if _, ok := gom.Objs[id]; ok {
+		gom.index().Set(id, image.Pt(obj.GetPos()))
+	}
+}
+
+// ObjectsAt returns the objects at pt
+func (gom *GameObjectMap) ObjectsAt(pt image.Point) []Object {
+	gom.m.Lock()
+	defer gom.m.Unlock()
+
+	var objs []Object
+	for _, id := range gom.index().At(pt) {
+		objs = append(objs, gom.Objs[id])
+	}
+
+	return objs
+}
+
+// ObjectsInRect returns the objects inside r
+func (gom *GameObjectMap) ObjectsInRect(r image.Rectangle) []Object {
+	gom.m.Lock()
+	defer gom.m.Unlock()
+
+	var objs []Object
+	for _, id := range gom.index().InRect(r) {
+		objs = append(objs, gom.Objs[id])
+	}
+
+	return objs
+}
+
+// Nearest returns the object closest to pt that filter accepts, or nil.
+// a nil filter accepts anything. filter runs without the map locked,
+// so it may use the map.
+func (gom *GameObjectMap) Nearest(pt image.Point, filter func(Object) bool) Object {
+	var best Object
+	bestdist := 0
+
+	for ring := 0; ; ring++ {
+		gom.m.Lock()
+		idx := gom.index()
+		ids, more := idx.Ring(pt, ring)
+		objs := make([]Object, 0, len(ids))
+		for _, id := range ids {
+			objs = append(objs, gom.Objs[id])
+		}
+		mindist := idx.RingDistance(ring + 1)
+		gom.m.Unlock()
+
+		for _, o := range objs {
+			if filter != nil && !filter(o) {
+				continue
+			}
+
+			d := image.Pt(o.GetPos()).Sub(pt)
+			if dist := d.X*d.X + d.Y*d.Y; best == nil || dist < bestdist {
+				best, bestdist = o, dist
+			}
+		}
+
+		// nothing further out can be closer
+		if !more || (best != nil && bestdist < mindist*mindist) {
+			return best
+		}
+	}
 }
 
 func (gom *GameObjectMap) FindObjectByID(id int) Object {
@@ -262,6 +458,40 @@ func (gom *GameObjectMap) Chan() <-chan Object {
 	return ch
 }
 
+// GameObjectMap holds interfaces, which json can't decode,
+// so it goes over the wire as a list of GameObjects.
+func (gom *GameObjectMap) MarshalJSON() ([]byte, error) {
+	gom.m.Lock()
+	defer gom.m.Unlock()
+
+	objs := make([]Object, 0, len(gom.Objs))
+	for _, o := range gom.Objs {
+		objs = append(objs, o)
+	}
+
+	return json.Marshal(objs)
+}
+
+func (gom *GameObjectMap) UnmarshalJSON(b []byte) error {
+	var objs []*GameObject
+	if err := json.Unmarshal(b, &objs); err != nil {
+		return err
+	}
+
+	gom.m.Lock()
+	defer gom.m.Unlock()
+
+	gom.Objs = make(map[int]Object)
+	for _, o := range objs {
+		gom.Objs[o.ID] = o
+	}
+
+	// reindex on next use
+	gom.grid = nil
+
+	return nil
+}
+
 // return a slice containing the objects
 // XXX: crappy hack so lua can iterate the contents
 func (gom *GameObjectMap) GetSlice() []Object {
@@ -0,0 +1,220 @@
+// Capture: packets recorded as JSON lines, one per packet, with when and
+// which way they went and whose session they belong to. The server writes
+// these, and tools read them back to replay a session.
+package gnet
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CAPTURE_IN  = "in"  // client to server
+	CAPTURE_OUT = "out" // server to client
+)
+
+// CaptureRecord is one line of a capture file
+type CaptureRecord struct {
+	Time    time.Time       `json:"time"`
+	Session string          `json:"session"`        // the server's id for the connection
+	User    string          `json:"user,omitempty"` // account name, once the hello has said
+	Dir     string          `json:"dir"`            // CAPTURE_IN or CAPTURE_OUT
+	Packet  json.RawMessage `json:"packet"`         // as the jsonl codec encodes it
+}
+
+// Decode gives the record's packet, its payload typed as registered
+func (cr *CaptureRecord) Decode() (*Packet, error) {
+	return UnmarshalJSONPacket(cr.Packet)
+}
+
+// Tag is the tag of the record's packet, without decoding the payload
+func (cr *CaptureRecord) Tag() string {
+	var jp jsonPacket
+	json.Unmarshal(cr.Packet, &jp)
+	return jp.Tag
+}
+
+func (cr *CaptureRecord) String() string {
+	return fmt.Sprintf("%s %s %s %s %s", cr.Time.Format(time.StampMilli), cr.Session, cr.User, cr.Dir, cr.Packet)
+}
+
+// CaptureFilter says which packets to keep. Empty sets match everything.
+type CaptureFilter struct {
+	Tags  map[string]bool // keep only these tags
+	Skip  map[string]bool // never these
+	Users map[string]bool // keep only these users or session ids, lowercased
+}
+
+// NewCaptureFilter makes a filter from lists of names, any of which may be empty
+func NewCaptureFilter(tags, skip, users []string) *CaptureFilter {
+	lower := make([]string, len(users))
+	for i, u := range users {
+		lower[i] = strings.ToLower(u)
+	}
+
+	return &CaptureFilter{Tags: nameSet(tags), Skip: nameSet(skip), Users: nameSet(lower)}
+}
+
+// set from a list of names, nil if there are none
+func nameSet(names []string) map[string]bool {
+	if len(names) == 0 {
+		return nil
+	}
+
+	set := make(map[string]bool, len(names))
+	for _, n := range names {
+		set[n] = true
+	}
+
+	return set
+}
+
+// Match reports whether a packet tagged tag in session of user is kept
+func (f *CaptureFilter) Match(tag, session, user string) bool {
+	if f == nil {
+		return true
+	}
+
+	if f.Skip[tag] {
+		return false
+	}
+
+	if len(f.Tags) > 0 && !f.Tags[tag] {
+		return false
+	}
+
+	if len(f.Users) > 0 && !f.Users[strings.ToLower(user)] && !f.Users[strings.ToLower(session)] {
+		return false
+	}
+
+	return true
+}
+
+// CaptureWriter appends CaptureRecords to a file. Safe to share between
+// sessions.
+type CaptureWriter struct {
+	Filter *CaptureFilter
+
+	w   io.WriteCloser
+	m   sync.Mutex
+	n   int   // records written
+	err error // first write error, after which we quietly give up
+}
+
+// CreateCapture starts a new capture in path, appending if it exists
+func CreateCapture(path string, filter *CaptureFilter) (*CaptureWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CaptureWriter{Filter: filter, w: f}, nil
+}
+
+// passwords stay out of captures
+func redact(pk *Packet) *Packet {
+	if l, ok := pk.Data.(*Login); ok {
+		return NewPacket(pk.Tag, &Login{Register: l.Register})
+	}
+
+	return pk
+}
+
+// Write records pk going dir in session if the filter keeps it
+func (cw *CaptureWriter) Write(dir, session, user string, pk *Packet) error {
+	if cw == nil || !cw.Filter.Match(pk.Tag, session, user) {
+		return nil
+	}
+
+	b, err := MarshalJSONPacket(redact(pk))
+	if err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(&CaptureRecord{
+		Time:    time.Now(),
+		Session: session,
+		User:    user,
+		Dir:     dir,
+		Packet:  b,
+	})
+	if err != nil {
+		return err
+	}
+
+	cw.m.Lock()
+	defer cw.m.Unlock()
+
+	if cw.err != nil {
+		return nil
+	}
+
+	if _, err := cw.w.Write(append(line, '\n')); err != nil {
+		cw.err = err
+		return err
+	}
+
+	cw.n++
+	return nil
+}
+
+// Count is how many records have been written
+func (cw *CaptureWriter) Count() int {
+	cw.m.Lock()
+	defer cw.m.Unlock()
+
+	return cw.n
+}
+
+func (cw *CaptureWriter) Close() error {
+	cw.m.Lock()
+	defer cw.m.Unlock()
+
+	if cw.err == nil {
+		cw.err = fmt.Errorf("capture closed")
+	}
+
+	return cw.w.Close()
+}
+
+// CaptureReader reads CaptureRecords back
+type CaptureReader struct {
+	Filter *CaptureFilter
+
+	r    *bufio.Reader
+	line int
+}
+
+func NewCaptureReader(r io.Reader, filter *CaptureFilter) *CaptureReader {
+	return &CaptureReader{Filter: filter, r: bufio.NewReader(r)}
+}
+
+// Next gives the next record the filter keeps, or io.EOF at the end
+func (cr *CaptureReader) Next() (*CaptureRecord, error) {
+	for {
+		b, err := cr.r.ReadBytes('\n')
+		if len(strings.TrimSpace(string(b))) == 0 {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		cr.line++
+
+		rec := new(CaptureRecord)
+		if err := json.Unmarshal(b, rec); err != nil {
+			return nil, fmt.Errorf("capture line %d: %s", cr.line, err)
+		}
+
+		if cr.Filter.Match(rec.Tag(), rec.Session, rec.User) {
+			return rec, nil
+		}
+	}
+}
@@ -0,0 +1,246 @@
+// Codec: pluggable wire encodings for Packets
+package gnet
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+const (
+	// every connection starts out speaking this
+	DEFAULT_CODEC = "gob"
+)
+
+type Encoder interface {
+	Encode(pk *Packet) error
+}
+
+type Decoder interface {
+	Decode() (*Packet, error)
+}
+
+// Codec makes Encoders and Decoders for one wire format
+type Codec interface {
+	Name() string
+	NewEncoder(w io.Writer) Encoder
+	NewDecoder(r *bufio.Reader) Decoder
+}
+
+var (
+	codecs  = make(map[string]Codec)
+	codecsm sync.RWMutex
+)
+
+// RegisterCodec makes c available for negotiation under c.Name()
+func RegisterCodec(c Codec) {
+	codecsm.Lock()
+	defer codecsm.Unlock()
+
+	codecs[c.Name()] = c
+}
+
+// GetCodec finds a registered Codec by name
+func GetCodec(name string) (Codec, bool) {
+	codecsm.RLock()
+	defer codecsm.RUnlock()
+
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// CodecNames lists the registered codecs
+func CodecNames() []string {
+	codecsm.RLock()
+	defer codecsm.RUnlock()
+
+	var names []string
+	for n := range codecs {
+		names = append(names, n)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// NegotiateCodec picks the first codec in wanted that is registered,
+// falling back to DEFAULT_CODEC.
+func NegotiateCodec(wanted []string) Codec {
+	for _, n := range wanted {
+		if c, ok := GetCodec(n); ok {
+			return c
+		}
+	}
+
+	c, _ := GetCodec(DEFAULT_CODEC)
+	return c
+}
+
+// GobCodec is the original encoding: a gob stream of interface values,
+// which is what gochanio put on the wire.
+type GobCodec struct{}
+
+func (GobCodec) Name() string {
+	return "gob"
+}
+
+func (GobCodec) NewEncoder(w io.Writer) Encoder {
+	return &gobEncoder{gob.NewEncoder(w)}
+}
+
+func (GobCodec) NewDecoder(r *bufio.Reader) Decoder {
+	// r is a ByteReader, so gob won't read past the end of a message
+	// and we can switch codecs after the handshake.
+	return &gobDecoder{gob.NewDecoder(r)}
+}
+
+type gobEncoder struct {
+	enc *gob.Encoder
+}
+
+func (e *gobEncoder) Encode(pk *Packet) error {
+	var x interface{} = pk
+	return e.enc.Encode(&x)
+}
+
+type gobDecoder struct {
+	dec *gob.Decoder
+}
+
+func (d *gobDecoder) Decode() (*Packet, error) {
+	var x interface{}
+	if err := d.dec.Decode(&x); err != nil {
+		return nil, err
+	}
+
+	pk, ok := x.(*Packet)
+	if !ok {
+		return nil, fmt.Errorf("gob: decoded %T, not a packet", x)
+	}
+
+	return pk, nil
+}
+
+// JSONCodec writes one JSON object per line, like {"tag":"Tchat","data":"hi"}.
+// Payloads are decoded into the type registered for the tag,
+// so this can be spoken by tools that know nothing about gob.
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string {
+	return "jsonl"
+}
+
+func (JSONCodec) NewEncoder(w io.Writer) Encoder {
+	return &jsonEncoder{w}
+}
+
+func (JSONCodec) NewDecoder(r *bufio.Reader) Decoder {
+	return &jsonDecoder{r}
+}
+
+// what a packet looks like on a json wire
+type jsonPacket struct {
+	Tag  string          `json:"tag"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+type jsonEncoder struct {
+	w io.Writer
+}
+
+func (e *jsonEncoder) Encode(pk *Packet) error {
+	b, err := MarshalJSONPacket(pk)
+	if err != nil {
+		return err
+	}
+
+	// one write per packet, newline included
+	_, err = e.w.Write(append(b, '\n'))
+	return err
+}
+
+type jsonDecoder struct {
+	r *bufio.Reader
+}
+
+func (d *jsonDecoder) Decode() (*Packet, error) {
+	for {
+		line, err := d.r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) == 0 {
+			if err != nil {
+				return nil, err
+			}
+			// skip blank lines
+			continue
+		}
+
+		return UnmarshalJSONPacket(line)
+	}
+}
+
+// MarshalJSONPacket encodes pk the way the jsonl codec does, without a newline
+func MarshalJSONPacket(pk *Packet) ([]byte, error) {
+	jp := jsonPacket{Tag: pk.Tag}
+
+	if pk.Data != nil {
+		b, err := json.Marshal(pk.Data)
+		if err != nil {
+			return nil, fmt.Errorf("json: packet %s: %s", pk.Tag, err)
+		}
+		jp.Data = b
+	}
+
+	return json.Marshal(&jp)
+}
+
+// UnmarshalJSONPacket decodes one jsonl packet, giving the payload the
+// type registered for its tag.
+func UnmarshalJSONPacket(b []byte) (*Packet, error) {
+	var jp jsonPacket
+	if err := json.Unmarshal(b, &jp); err != nil {
+		return nil, fmt.Errorf("json: %s", err)
+	}
+
+	pk := &Packet{Tag: jp.Tag}
+
+	m, ok := Lookup(jp.Tag)
+	if !ok {
+		return nil, fmt.Errorf("json: unknown packet tag %q", jp.Tag)
+	}
+
+	if m.Type == nil || len(jp.Data) == 0 || string(jp.Data) == "null" {
+		return pk, nil
+	}
+
+	if m.Type.Kind() == reflect.Interface {
+		return nil, fmt.Errorf("json: can't decode %s payload into interface %s", jp.Tag, m.Type)
+	}
+
+	var v reflect.Value
+	if m.Type.Kind() == reflect.Ptr {
+		v = reflect.New(m.Type.Elem())
+		if err := json.Unmarshal(jp.Data, v.Interface()); err != nil {
+			return nil, fmt.Errorf("json: packet %s: %s", jp.Tag, err)
+		}
+	} else {
+		p := reflect.New(m.Type)
+		if err := json.Unmarshal(jp.Data, p.Interface()); err != nil {
+			return nil, fmt.Errorf("json: packet %s: %s", jp.Tag, err)
+		}
+		v = p.Elem()
+	}
+
+	pk.Data = v.Interface()
+	return pk, nil
+}
+
+func init() {
+	RegisterCodec(GobCodec{})
+	RegisterCodec(JSONCodec{})
+}
@@ -0,0 +1,82 @@
+// Conn: a net.Conn that reads and writes Packets through a Codec
+package gnet
+
+import (
+	"bufio"
+	"net"
+	"sync"
+)
+
+type Conn struct {
+	net.Conn
+
+	r     *bufio.Reader
+	codec Codec
+	enc   Encoder
+	dec   Decoder
+
+	rm sync.Mutex // held while decoding
+	wm sync.Mutex // held while encoding
+}
+
+// NewConn wraps c, speaking codec until SetCodec is called
+func NewConn(c net.Conn, codec Codec) *Conn {
+	conn := &Conn{Conn: c, r: bufio.NewReader(c)}
+	conn.SetCodec(codec)
+	return conn
+}
+
+// Sniff guesses the codec a peer is speaking from its first byte.
+// A jsonl stream starts with '{'; a gob stream starts with a short
+// message length and never does.
+func (c *Conn) Sniff() (Codec, error) {
+	b, err := c.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if b[0] == '{' {
+		codec, _ := GetCodec("jsonl")
+		return codec, nil
+	}
+
+	codec, _ := GetCodec(DEFAULT_CODEC)
+	return codec, nil
+}
+
+// Codec returns the codec currently in use
+func (c *Conn) Codec() Codec {
+	c.wm.Lock()
+	defer c.wm.Unlock()
+
+	return c.codec
+}
+
+// SetCodec switches both directions to codec. Both peers must switch at
+// the same point in the stream, which the handshake arranges.
+func (c *Conn) SetCodec(codec Codec) {
+	c.rm.Lock()
+	c.wm.Lock()
+	defer c.rm.Unlock()
+	defer c.wm.Unlock()
+
+	c.codec = codec
+	c.enc = codec.NewEncoder(c.Conn)
+	c.dec = codec.NewDecoder(c.r)
+}
+
+// ReadPacket decodes the next packet from the peer
+func (c *Conn) ReadPacket() (*Packet, error) {
+	c.rm.Lock()
+	defer c.rm.Unlock()
+
+	return c.dec.Decode()
+}
+
+// WritePacket encodes pk to the peer
+func (c *Conn) WritePacket(pk *Packet) error {
+	c.wm.Lock()
+	defer c.wm.Unlock()
+
+	return c.enc.Encode(pk)
+}
@@ -0,0 +1,212 @@
+// Handshake: versioned hello exchange sent as the payload of Tconnect
+package gnet
+
+import (
+	"encoding/gob"
+	"fmt"
+	"time"
+)
+
+const (
+	// bump this whenever the wire format or packet semantics change
+	PROTOCOL_VERSION = 1
+)
+
+type RejectReason int
+
+const (
+	REJECT_VERSION  RejectReason = iota // protocol version mismatch
+	REJECT_BADHELLO                     // malformed or missing hello
+	REJECT_USERNAME                     // unusable username
+	REJECT_AUTH                         // login failed
+	REJECT_BANNED                       // account is banned for now
+)
+
+var rejectReasons = map[RejectReason]string{
+	REJECT_VERSION:  "version mismatch",
+	REJECT_BADHELLO: "bad hello",
+	REJECT_USERNAME: "bad username",
+	REJECT_AUTH:     "bad login",
+	REJECT_BANNED:   "banned",
+}
+
+func (r RejectReason) String() string {
+	if s, ok := rejectReasons[r]; ok {
+		return s
+	}
+
+	return fmt.Sprintf("reason %d", int(r))
+}
+
+// Hello is sent by the client as the payload of Tconnect
+type Hello struct {
+	Version       int      // protocol version the client speaks
+	ClientName    string   // client program name
+	ClientVersion string   // client program version
+	Username      string   // requested username
+	Features      []string // optional features the client understands
+	Codecs        []string // wire codecs the client can speak, preferred first
+	ResumeToken   string   // token from an earlier Welcome, to take back our player
+}
+
+func (h *Hello) String() string {
+	return fmt.Sprintf("(hello v%d %s/%s %s %v %v)", h.Version, h.ClientName,
+		h.ClientVersion, h.Username, h.Features, h.Codecs)
+}
+
+// Welcome is the server's Rconnect payload when a Hello is accepted
+type Welcome struct {
+	Version       int      // protocol version the server speaks
+	ServerName    string   // server program name
+	ServerVersion string   // server program version
+	Features      []string // features enabled for this session
+	Codec         string   // codec both sides switch to after this packet
+	ResumeToken   string   // present this in a later Hello to resume after a drop
+}
+
+func (w *Welcome) String() string {
+	return fmt.Sprintf("(welcome v%d %s/%s %v %s)", w.Version, w.ServerName,
+		w.ServerVersion, w.Features, w.Codec)
+}
+
+// Login is sent by the client as the payload of Tlogin, right after Rconnect.
+// The account is the one named by the Hello's Username.
+type Login struct {
+	Password string // account password
+	Register bool   // create the account instead of logging in to it
+}
+
+// never log the password
+func (l *Login) String() string {
+	return fmt.Sprintf("(login register:%t)", l.Register)
+}
+
+// Reject is the server's Rreject payload when a Hello is refused
+type Reject struct {
+	Reason        RejectReason // why we were refused
+	Message       string       // human readable explanation
+	ServerVersion int          // protocol version the server speaks
+}
+
+func (r *Reject) String() string {
+	return fmt.Sprintf("(reject %s: %s)", r.Reason, r.Message)
+}
+
+func (r *Reject) Error() string {
+	return fmt.Sprintf("server rejected connection (%s): %s", r.Reason, r.Message)
+}
+
+// NewHello makes a Hello for the current protocol version
+func NewHello(client, version, username string, features ...string) *Hello {
+	return &Hello{
+		Version:       PROTOCOL_VERSION,
+		ClientName:    client,
+		ClientVersion: version,
+		Username:      username,
+		Features:      features,
+	}
+}
+
+// HasFeature reports whether feature is present in features
+func HasFeature(features []string, feature string) bool {
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// NegotiateFeatures returns the features in wanted that are also in supported
+func NegotiateFeatures(wanted []string, supported map[string]bool) []string {
+	var res []string
+	for _, f := range wanted {
+		if supported[f] && !HasFeature(res, f) {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+// read the server's answer to a handshake step, giving up after timeout
+func readReply(c *Conn, step string, timeout time.Duration) (*Packet, error) {
+	c.SetReadDeadline(time.Now().Add(timeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	p, err := c.ReadPacket()
+	if err != nil {
+		return nil, fmt.Errorf("no %s reply from server: %s", step, err)
+	}
+
+	if err := Validate(p, SERVER_TO_CLIENT); err != nil {
+		return nil, fmt.Errorf("bad %s reply: %s", step, err)
+	}
+
+	if rej, ok := p.Data.(*Reject); ok {
+		return nil, rej
+	}
+
+	return p, nil
+}
+
+// ClientHello is the client's side of Tconnect: it sends hello on c and
+// waits for the server to accept it, then switches c to the codec the
+// server chose. A refusal is returned as a *Reject. Log in with
+// ClientLogin next; nothing else may be sent or read on c before that.
+func ClientHello(c *Conn, hello *Hello, timeout time.Duration) (*Welcome, error) {
+	if err := c.WritePacket(NewPacket("Tconnect", hello)); err != nil {
+		return nil, fmt.Errorf("can't send hello: %s", err)
+	}
+
+	p, err := readReply(c, "handshake", timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	switch p.Tag {
+	case "Rconnect":
+	case "Rchat":
+		// an older server may only be able to tell us in chat
+		return nil, fmt.Errorf("server refused connection: %s", p.Data)
+	default:
+		return nil, fmt.Errorf("unexpected handshake reply %s", p)
+	}
+
+	w := p.Data.(*Welcome)
+
+	codec, ok := GetCodec(w.Codec)
+	if !ok {
+		return nil, fmt.Errorf("server chose unknown codec %q", w.Codec)
+	}
+
+	c.SetCodec(codec)
+
+	return w, nil
+}
+
+// ClientLogin is the client's side of Tlogin, right after ClientHello.
+// It returns the account name the server logged us in as, which may be
+// spelled differently from the one in our hello.
+func ClientLogin(c *Conn, login *Login, timeout time.Duration) (string, error) {
+	if err := c.WritePacket(NewPacket("Tlogin", login)); err != nil {
+		return "", fmt.Errorf("can't send login: %s", err)
+	}
+
+	p, err := readReply(c, "login", timeout)
+	if err != nil {
+		return "", err
+	}
+
+	if p.Tag != "Rlogin" {
+		return "", fmt.Errorf("unexpected login reply %s", p)
+	}
+
+	return p.Data.(string), nil
+}
+
+func init() {
+	gob.Register(&Hello{})
+	gob.Register(&Welcome{})
+	gob.Register(&Login{})
+	gob.Register(&Reject{})
+}
@@ -0,0 +1,31 @@
+// Ping: heartbeat payload, echoed back by the server
+package gnet
+
+import (
+	"encoding/gob"
+	"fmt"
+	"time"
+)
+
+type Ping struct {
+	Seq  uint32        // increases by one per ping
+	Sent int64         // sender's clock in unix nanoseconds
+	RTT  time.Duration // sender's last measured round trip, for the other side's benefit
+}
+
+func NewPing(seq uint32, rtt time.Duration) *Ping {
+	return &Ping{Seq: seq, Sent: time.Now().UnixNano(), RTT: rtt}
+}
+
+// Since returns how long ago the ping was sent, by our clock
+func (p *Ping) Since() time.Duration {
+	return time.Duration(time.Now().UnixNano() - p.Sent)
+}
+
+func (p *Ping) String() string {
+	return fmt.Sprintf("(ping %d rtt %s)", p.Seq, p.RTT)
+}
+
+func init() {
+	gob.Register(&Ping{})
+}
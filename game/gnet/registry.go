@@ -0,0 +1,218 @@
+// Registry: every packet tag is declared here with its payload type and
+// direction, so handlers can validate packets instead of panicking.
+package gnet
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+type Direction int
+
+const (
+	CLIENT_TO_SERVER Direction = 1 << iota // T-messages
+	SERVER_TO_CLIENT                       // R-messages
+
+	BOTH_DIRECTIONS = CLIENT_TO_SERVER | SERVER_TO_CLIENT
+)
+
+func (d Direction) String() string {
+	switch d {
+	case CLIENT_TO_SERVER:
+		return "client->server"
+	case SERVER_TO_CLIENT:
+		return "server->client"
+	case BOTH_DIRECTIONS:
+		return "both"
+	}
+
+	return fmt.Sprintf("direction %d", int(d))
+}
+
+// Message describes one kind of packet
+type Message struct {
+	Tag  string       // packet tag
+	Dir  Direction    // which way this packet may travel
+	Type reflect.Type // payload type, nil if the packet carries no payload
+	Desc string       // what the packet is for
+}
+
+func (m *Message) String() string {
+	t := "nil"
+	if m.Type != nil {
+		t = m.Type.String()
+	}
+	return fmt.Sprintf("(%s %s %s)", m.Tag, m.Dir, t)
+}
+
+var (
+	registry = make(map[string]*Message)
+	regm     sync.RWMutex
+)
+
+// Register declares a packet tag. payload is an example value of the
+// payload type (e.g. "" or &Hello{}), or nil for packets without one.
+// A pointer to an interface, e.g. (*fmt.Stringer)(nil), accepts any
+// implementation of that interface.
+// Registering the same tag twice is a programming error and panics.
+func Register(tag string, dir Direction, payload interface{}, desc string) *Message {
+	m := &Message{Tag: tag, Dir: dir, Desc: desc}
+
+	if payload != nil {
+		m.Type = reflect.TypeOf(payload)
+		if m.Type.Kind() == reflect.Ptr && m.Type.Elem().Kind() == reflect.Interface {
+			m.Type = m.Type.Elem()
+		}
+	}
+
+	regm.Lock()
+	defer regm.Unlock()
+
+	if _, ok := registry[tag]; ok {
+		panic(fmt.Sprintf("gnet: Register: tag %s registered twice", tag))
+	}
+
+	registry[tag] = m
+	return m
+}
+
+// Lookup finds the Message registered for tag
+func Lookup(tag string) (*Message, bool) {
+	regm.RLock()
+	defer regm.RUnlock()
+
+	m, ok := registry[tag]
+	return m, ok
+}
+
+// Messages returns every registered Message, sorted by tag
+func Messages() []*Message {
+	regm.RLock()
+	defer regm.RUnlock()
+
+	res := make([]*Message, 0, len(registry))
+	for _, m := range registry {
+		res = append(res, m)
+	}
+
+	sort.Sort(byTag(res))
+	return res
+}
+
+type byTag []*Message
+
+func (b byTag) Len() int           { return len(b) }
+func (b byTag) Less(i, j int) bool { return b[i].Tag < b[j].Tag }
+func (b byTag) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// Validate checks that pk has a registered tag, may travel in dir,
+// and carries a payload of the registered type.
+func Validate(pk *Packet, dir Direction) error {
+	if pk == nil {
+		return fmt.Errorf("nil packet")
+	}
+
+	m, ok := Lookup(pk.Tag)
+	if !ok {
+		return fmt.Errorf("unknown packet tag %q", pk.Tag)
+	}
+
+	if m.Dir&dir == 0 {
+		return fmt.Errorf("packet %s not allowed %s", pk.Tag, dir)
+	}
+
+	if m.Type == nil {
+		if pk.Data != nil {
+			return fmt.Errorf("packet %s takes no payload, got %T", pk.Tag, pk.Data)
+		}
+		return nil
+	}
+
+	if pk.Data == nil {
+		return fmt.Errorf("packet %s missing %s payload", pk.Tag, m.Type)
+	}
+
+	t := reflect.TypeOf(pk.Data)
+	if m.Type.Kind() == reflect.Interface {
+		if !t.Implements(m.Type) {
+			return fmt.Errorf("packet %s payload %s does not implement %s", pk.Tag, t, m.Type)
+		}
+	} else if t != m.Type {
+		return fmt.Errorf("packet %s payload is %s, expected %s", pk.Tag, t, m.Type)
+	}
+
+	if v := reflect.ValueOf(pk.Data); v.Kind() == reflect.Ptr && v.IsNil() {
+		return fmt.Errorf("packet %s has nil %s payload", pk.Tag, t)
+	}
+
+	return nil
+}
+
+// Handler deals with one validated packet
+type Handler func(pk *Packet) error
+
+// Call validates pk for dir and then runs h, turning a panic in h into an error.
+func Call(pk *Packet, dir Direction, h Handler) (err error) {
+	if err = Validate(pk, dir); err != nil {
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler for %s panicked: %v", pk.Tag, r)
+		}
+	}()
+
+	return h(pk)
+}
+
+// Dispatcher routes validated packets to per-tag handlers
+type Dispatcher struct {
+	dir      Direction // direction of packets we receive
+	handlers map[string]Handler
+	m        sync.RWMutex
+}
+
+// NewDispatcher makes a Dispatcher for packets travelling in dir
+func NewDispatcher(dir Direction) *Dispatcher {
+	return &Dispatcher{dir: dir, handlers: make(map[string]Handler)}
+}
+
+// Handle sets the handler for tag. The tag must be registered for our
+// direction; anything else is a programming error and panics.
+func (d *Dispatcher) Handle(tag string, h Handler) {
+	m, ok := Lookup(tag)
+	if !ok {
+		panic(fmt.Sprintf("gnet: Dispatcher: Handle: unknown tag %s", tag))
+	}
+
+	if m.Dir&d.dir == 0 {
+		panic(fmt.Sprintf("gnet: Dispatcher: Handle: tag %s can't travel %s", tag, d.dir))
+	}
+
+	d.m.Lock()
+	d.handlers[tag] = h
+	d.m.Unlock()
+}
+
+// Dispatch validates pk and hands it to its handler
+func (d *Dispatcher) Dispatch(pk *Packet) error {
+	if pk == nil {
+		return fmt.Errorf("nil packet")
+	}
+
+	d.m.RLock()
+	h, ok := d.handlers[pk.Tag]
+	d.m.RUnlock()
+
+	if !ok {
+		if err := Validate(pk, d.dir); err != nil {
+			return err
+		}
+		return fmt.Errorf("no handler for packet %s", pk.Tag)
+	}
+
+	return Call(pk, d.dir, h)
+}
@@ -0,0 +1,210 @@
+// SpatialGrid: object ids bucketed by position, so looking for things
+// in an area only visits the cells it covers instead of every object.
+package game
+
+import (
+	"image"
+)
+
+const (
+	DEFAULT_GRID_CELL = 16
+)
+
+// SpatialGrid isn't safe for concurrent use
+type SpatialGrid struct {
+	CellSize int
+
+	cells map[image.Point]map[int]image.Point // cell -> id -> position
+	pos   map[int]image.Point                 // id -> position
+
+	// every cell that ever held anything is in min..max, inclusive, so
+	// searches know when there's nothing further out
+	min, max image.Point
+	used     bool
+}
+
+func NewSpatialGrid(cellsize int) *SpatialGrid {
+	if cellsize <= 0 {
+		cellsize = DEFAULT_GRID_CELL
+	}
+
+	return &SpatialGrid{
+		CellSize: cellsize,
+		cells:    make(map[image.Point]map[int]image.Point),
+		pos:      make(map[int]image.Point),
+	}
+}
+
+// round towards negative infinity, so -1 isn't in the same cell as 1
+func floordiv(a, b int) int {
+	if a < 0 {
+		return (a - b + 1) / b
+	}
+
+	return a / b
+}
+
+// cell holding pt
+func (sg *SpatialGrid) cell(pt image.Point) image.Point {
+	return image.Pt(floordiv(pt.X, sg.CellSize), floordiv(pt.Y, sg.CellSize))
+}
+
+// Set puts id at pt, moving it if it was somewhere else
+func (sg *SpatialGrid) Set(id int, pt image.Point) {
+	if old, ok := sg.pos[id]; ok {
+		if old == pt {
+			return
+		}
+		sg.Remove(id)
+	}
+
+	c := sg.cell(pt)
+	if sg.cells[c] == nil {
+		sg.cells[c] = make(map[int]image.Point)
+	}
+
+	if !sg.used {
+		sg.min, sg.max, sg.used = c, c, true
+	} else {
+		if c.X < sg.min.X {
+			sg.min.X = c.X
+		}
+		if c.Y < sg.min.Y {
+			sg.min.Y = c.Y
+		}
+		if c.X > sg.max.X {
+			sg.max.X = c.X
+		}
+		if c.Y > sg.max.Y {
+			sg.max.Y = c.Y
+		}
+	}
+
+	sg.cells[c][id] = pt
+	sg.pos[id] = pt
+}
+
+func (sg *SpatialGrid) Remove(id int) {
+	pt, ok := sg.pos[id]
+	if !ok {
+		return
+	}
+
+	c := sg.cell(pt)
+	delete(sg.cells[c], id)
+	if len(sg.cells[c]) == 0 {
+		delete(sg.cells, c)
+	}
+
+	delete(sg.pos, id)
+}
+
+// Pos returns where id is, if it is in the grid
+func (sg *SpatialGrid) Pos(id int) (image.Point, bool) {
+	pt, ok := sg.pos[id]
+	return pt, ok
+}
+
+func (sg *SpatialGrid) Len() int {
+	return len(sg.pos)
+}
+
+// At returns the ids at pt
+func (sg *SpatialGrid) At(pt image.Point) []int {
+	var ids []int
+	for id, p := range sg.cells[sg.cell(pt)] {
+		if p == pt {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// Ring returns the ids in the cells ring cells away from the one holding pt,
+// in either direction. more is false if there are no cells further out.
+func (sg *SpatialGrid) Ring(pt image.Point, ring int) (ids []int, more bool) {
+	if !sg.used {
+		return nil, false
+	}
+
+	center := sg.cell(pt)
+	lo := center.Sub(image.Pt(ring, ring))
+	hi := center.Add(image.Pt(ring, ring))
+
+	add := func(cx, cy int) {
+		for id := range sg.cells[image.Pt(cx, cy)] {
+			ids = append(ids, id)
+		}
+	}
+
+	// only the ring's edges, and only where cells have ever been used
+	for cx := imax(lo.X, sg.min.X); cx <= imin(hi.X, sg.max.X); cx++ {
+		add(cx, lo.Y)
+		if hi.Y != lo.Y {
+			add(cx, hi.Y)
+		}
+	}
+
+	for cy := imax(lo.Y+1, sg.min.Y); cy <= imin(hi.Y-1, sg.max.Y); cy++ {
+		add(lo.X, cy)
+		if hi.X != lo.X {
+			add(hi.X, cy)
+		}
+	}
+
+	more = lo.X > sg.min.X || lo.Y > sg.min.Y || hi.X < sg.max.X || hi.Y < sg.max.Y
+
+	return ids, more
+}
+
+func imin(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+func imax(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+// RingDistance is the least distance from a point to anything in the
+// cells ring cells away from its own
+func (sg *SpatialGrid) RingDistance(ring int) int {
+	if ring <= 0 {
+		return 0
+	}
+
+	return (ring-1)*sg.CellSize + 1
+}
+
+// InRect returns the ids inside r
+func (sg *SpatialGrid) InRect(r image.Rectangle) []int {
+	var ids []int
+
+	r = r.Canon()
+	if r.Empty() {
+		return ids
+	}
+
+	min := sg.cell(r.Min)
+	max := sg.cell(r.Max.Sub(image.Pt(1, 1)))
+
+	for cy := min.Y; cy <= max.Y; cy++ {
+		for cx := min.X; cx <= max.X; cx++ {
+			for id, p := range sg.cells[image.Pt(cx, cy)] {
+				if p.In(r) {
+					ids = append(ids, id)
+				}
+			}
+		}
+	}
+
+	return ids
+}
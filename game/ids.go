@@ -0,0 +1,60 @@
+// Object IDs: the server hands them out and saves where it got to, so
+// they stay unique across restarts. Clients only make placeholders until
+// the server tells them about the real objects, and theirs count down
+// from -1 so they can never be mistaken for the server's.
+package game
+
+import (
+	"sync"
+)
+
+var (
+	// where NewGameObject gets its IDs. The client swaps in
+	// NewPlaceholderIDAllocator before making any objects.
+	IDs = NewIDAllocator(1)
+)
+
+// IDAllocator hands out object IDs, counting from where it was started
+type IDAllocator struct {
+	next int
+	step int // 1 counting up, -1 counting down
+	m    sync.Mutex
+}
+
+// NewIDAllocator counts up from first
+func NewIDAllocator(first int) *IDAllocator {
+	return &IDAllocator{next: first, step: 1}
+}
+
+// NewPlaceholderIDAllocator counts down from -1, for client side objects
+func NewPlaceholderIDAllocator() *IDAllocator {
+	return &IDAllocator{next: -1, step: -1}
+}
+
+// Next hands out an ID nobody has had from a
+func (a *IDAllocator) Next() int {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	id := a.next
+	a.next += a.step
+	return id
+}
+
+// Peek is the ID Next hands out next, to save and Reserve up to later
+func (a *IDAllocator) Peek() int {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	return a.next
+}
+
+// Reserve makes sure a never hands out id, or anything it counted past to get there
+func (a *IDAllocator) Reserve(id int) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if (id-a.next)*a.step >= 0 {
+		a.next = id + a.step
+	}
+}
@@ -0,0 +1,61 @@
+package game
+
+import (
+	"testing"
+)
+
+func TestIDAllocatorReserve(t *testing.T) {
+	tests := []struct {
+		name    string
+		a       *IDAllocator
+		reserve []int
+		want    []int // what Next hands out after
+	}{
+		{"nothing reserved", NewIDAllocator(1), nil, []int{1, 2, 3}},
+		{"ahead", NewIDAllocator(1), []int{5}, []int{6, 7}},
+		{"the next one", NewIDAllocator(1), []int{1}, []int{2}},
+		{"behind", NewIDAllocator(10), []int{3}, []int{10, 11}},
+		{"out of order", NewIDAllocator(1), []int{8, 4, 6}, []int{9}},
+		{"zero", NewIDAllocator(1), []int{0}, []int{1}},
+		{"placeholders ahead", NewPlaceholderIDAllocator(), []int{-5}, []int{-6, -7}},
+		{"placeholders behind", NewPlaceholderIDAllocator(), []int{3}, []int{-1, -2}},
+	}
+
+	for _, tt := range tests {
+		for _, id := range tt.reserve {
+			tt.a.Reserve(id)
+		}
+
+		if peek := tt.a.Peek(); peek != tt.want[0] {
+			t.Errorf("%s: Peek %d, want %d", tt.name, peek, tt.want[0])
+		}
+
+		for _, want := range tt.want {
+			if got := tt.a.Next(); got != want {
+				t.Errorf("%s: Next %d, want %d", tt.name, got, want)
+			}
+		}
+	}
+}
+
+func TestIDAllocatorReserveAfterNext(t *testing.T) {
+	a := NewIDAllocator(1)
+
+	seen := make(map[int]bool)
+	for i := 0; i < 3; i++ {
+		seen[a.Next()] = true
+	}
+
+	// a restored object takes back an id we already handed out: nothing
+	// new may get it, or any id before it
+	a.Reserve(2)
+	a.Reserve(7)
+
+	for i := 0; i < 5; i++ {
+		id := a.Next()
+		if seen[id] || id <= 7 {
+			t.Fatalf("Next handed out %d, which was used or reserved", id)
+		}
+		seen[id] = true
+	}
+}
@@ -0,0 +1,38 @@
+// Input: a numbered player action. the server tells the client the last
+// one it ran, so the client knows which of its predictions still stand.
+package game
+
+import (
+	"encoding/gob"
+	"fmt"
+)
+
+func init() {
+	gob.Register(&Input{})
+}
+
+var (
+	// what each key does, for everything that plays from a terminal
+	KeyActions = map[rune]Action{
+		'w': DIR_UP,
+		'k': DIR_UP,
+		'a': DIR_LEFT,
+		'h': DIR_LEFT,
+		's': DIR_DOWN,
+		'j': DIR_DOWN,
+		'd': DIR_RIGHT,
+		'l': DIR_RIGHT,
+		',': ACTION_ITEM_PICKUP,
+		'x': ACTION_ITEM_DROP,
+		'i': ACTION_ITEM_LIST_INVENTORY,
+	}
+)
+
+type Input struct {
+	Seq    uint32 // counts up from 1 on each connection
+	Action Action
+}
+
+func (in Input) String() string {
+	return fmt.Sprintf("#%d %d", in.Seq, int(in.Action))
+}
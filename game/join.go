@@ -0,0 +1,23 @@
+// Join: everything a client needs to enter the world, in one message,
+// so it never hears about its player before it has the map or the
+// objects around it.
+package game
+
+import (
+	"encoding/gob"
+	"fmt"
+)
+
+func init() {
+	gob.Register(&Join{})
+}
+
+type Join struct {
+	Map      *MapChunk // the world's terrain
+	PlayerID int       // object the client controls, 0 if none
+	Snapshot *Snapshot // the objects the client can see, from the empty world
+}
+
+func (j Join) String() string {
+	return fmt.Sprintf("player %d map %s %s", j.PlayerID, j.Map, j.Snapshot)
+}
@@ -4,6 +4,7 @@ package game
 import (
 	"bufio"
 	"encoding/gob"
+	"encoding/json"
 	"fmt"
 	"github.com/nsf/termbox-go"
 	"github.com/nsf/tulib"
@@ -131,6 +132,70 @@ func (mc *MapChunk) String() string {
 	return fmt.Sprintf("(%s %s objs %d players %d)", mc.Size, mc.Rect, len(mc.GameObjects), len(mc.Players))
 }
 
+// json form of a MapChunk. terrain is sent as rows of map glyphs,
+// the same as a map file, instead of 65536 Terrain structs.
+type jsonMapChunk struct {
+	Size        image.Point
+	Rect        image.Rectangle
+	Rows        []string
+	GameObjects []*GameObject
+	Players     []*Player
+}
+
+func (mc *MapChunk) MarshalJSON() ([]byte, error) {
+	jmc := jsonMapChunk{
+		Size:        mc.Size,
+		Rect:        mc.Rect,
+		Rows:        make([]string, mc.Size.Y),
+		GameObjects: mc.GameObjects,
+		Players:     mc.Players,
+	}
+
+	row := make([]rune, mc.Size.X)
+	for y := 0; y < mc.Size.Y; y++ {
+		for x := 0; x < mc.Size.X; x++ {
+			row[x] = mc.Locations[x][y].Glyph.Ch
+		}
+		jmc.Rows[y] = string(row)
+	}
+
+	return json.Marshal(&jmc)
+}
+
+func (mc *MapChunk) UnmarshalJSON(b []byte) error {
+	var jmc jsonMapChunk
+	if err := json.Unmarshal(b, &jmc); err != nil {
+		return err
+	}
+
+	if len(jmc.Rows) != jmc.Size.Y {
+		return fmt.Errorf("map has %d rows, expected %d", len(jmc.Rows), jmc.Size.Y)
+	}
+
+	mc.Size = jmc.Size
+	mc.Rect = jmc.Rect
+	mc.GameObjects = jmc.GameObjects
+	mc.Players = jmc.Players
+
+	mc.Locations = make([][]*Terrain, mc.Size.X)
+	for x := range mc.Locations {
+		mc.Locations[x] = make([]*Terrain, mc.Size.Y)
+	}
+
+	for y, str := range jmc.Rows {
+		row := []rune(str)
+		if len(row) != mc.Size.X {
+			return fmt.Errorf("map row %d has %d tiles, expected %d", y, len(row), mc.Size.X)
+		}
+
+		for x, r := range row {
+			mc.Locations[x][y], _ = GlyphToTerrain(r)
+		}
+	}
+
+	return nil
+}
+
 func NewMapChunk() *MapChunk {
 	ch := MapChunk{Size: image.Pt(MAP_WIDTH, MAP_HEIGHT)}
 	ch.Rect = image.Rect(0, 0, MAP_WIDTH, MAP_HEIGHT)
@@ -0,0 +1,177 @@
+// Match recordings: the whole world as the server saw it, tick by tick,
+// so a match can be watched again after it's over. A match file is json
+// lines, a MatchHeader and then a MatchFrame for every tick where
+// something changed.
+package game
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// bump this whenever the match file format changes
+	MATCH_VERSION = 1
+
+	// frames between the states Match keeps for seeking
+	MATCH_KEYFRAME_EVERY = 100
+)
+
+// MatchHeader is the first line of a match file
+type MatchHeader struct {
+	Version   int       // MATCH_VERSION of the server that recorded it
+	Name      string    // what the server called the match
+	Started   time.Time // when recording started
+	TickRate  int       // server ticks per second
+	FirstTick uint64    // server tick when recording started
+	Map       *MapChunk // the world's terrain
+}
+
+// MatchFrame is what changed in one server tick
+type MatchFrame struct {
+	Tick   uint64         // server tick
+	Deltas []*ObjectDelta `json:",omitempty"` // from the world as of the last frame
+	Chat   []string       `json:",omitempty"` // what everyone was told
+}
+
+// MatchWriter writes a match file
+type MatchWriter struct {
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+// NewMatchWriter starts a match file on w with hdr
+func NewMatchWriter(w io.WriteCloser, hdr *MatchHeader) (*MatchWriter, error) {
+	mw := &MatchWriter{w: w, enc: json.NewEncoder(w)}
+
+	if err := mw.enc.Encode(hdr); err != nil {
+		return nil, err
+	}
+
+	return mw, nil
+}
+
+// WriteFrame adds f to the match
+func (mw *MatchWriter) WriteFrame(f *MatchFrame) error {
+	return mw.enc.Encode(f)
+}
+
+func (mw *MatchWriter) Close() error {
+	return mw.w.Close()
+}
+
+// Match is a whole recorded match, read back for watching
+type Match struct {
+	MatchHeader
+	Frames []*MatchFrame
+
+	// keyframes[i] is the world after the first i*MATCH_KEYFRAME_EVERY frames
+	keyframes []WorldState
+}
+
+// ReadMatch reads a match file
+func ReadMatch(r io.Reader) (*Match, error) {
+	m := new(Match)
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	if err := dec.Decode(&m.MatchHeader); err != nil {
+		return nil, fmt.Errorf("can't read match header: %s", err)
+	}
+
+	if m.Version != MATCH_VERSION {
+		return nil, fmt.Errorf("match file version %d, we read version %d", m.Version, MATCH_VERSION)
+	}
+
+	if m.TickRate <= 0 {
+		return nil, fmt.Errorf("match has bad tick rate %d", m.TickRate)
+	}
+
+	for {
+		f := new(MatchFrame)
+		if err := dec.Decode(f); err == io.EOF {
+			break
+		} else if err != nil {
+			// a server that crashed leaves half a line at the end
+			if len(m.Frames) > 0 {
+				break
+			}
+			return nil, fmt.Errorf("can't read match frame %d: %s", len(m.Frames), err)
+		}
+
+		m.Frames = append(m.Frames, f)
+	}
+
+	state := WorldState{}
+	for i, f := range m.Frames {
+		if i%MATCH_KEYFRAME_EVERY == 0 {
+			m.keyframes = append(m.keyframes, state)
+		}
+		state = state.Apply(f.Deltas)
+	}
+
+	return m, nil
+}
+
+// LastTick is the server tick of the last frame
+func (m *Match) LastTick() uint64 {
+	if len(m.Frames) == 0 {
+		return m.FirstTick
+	}
+
+	return m.Frames[len(m.Frames)-1].Tick
+}
+
+// TickTime is how far into the match tick is
+func (m *Match) TickTime(tick uint64) time.Duration {
+	if tick < m.FirstTick {
+		return 0
+	}
+
+	return time.Duration(tick-m.FirstTick) * time.Second / time.Duration(m.TickRate)
+}
+
+// Length is how long the match went on for
+func (m *Match) Length() time.Duration {
+	return m.TickTime(m.LastTick())
+}
+
+// FramesBefore is how many frames happened before tick, or at it
+func (m *Match) FramesBefore(tick uint64) int {
+	lo, hi := 0, len(m.Frames)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if m.Frames[mid].Tick <= tick {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	return lo
+}
+
+// StateAt is the world after the first n frames
+func (m *Match) StateAt(n int) WorldState {
+	if n <= 0 || len(m.keyframes) == 0 {
+		return WorldState{}
+	}
+
+	if n > len(m.Frames) {
+		n = len(m.Frames)
+	}
+
+	k := n / MATCH_KEYFRAME_EVERY
+	if k >= len(m.keyframes) {
+		k = len(m.keyframes) - 1
+	}
+
+	state := m.keyframes[k]
+	for _, f := range m.Frames[k*MATCH_KEYFRAME_EVERY : n] {
+		state = state.Apply(f.Deltas)
+	}
+
+	return state
+}
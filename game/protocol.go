@@ -0,0 +1,41 @@
+// Protocol: the packets spoken between client and server.
+// Add new messages here so both sides agree on their payloads.
+package game
+
+import (
+	"github.com/mischief/goland/game/gnet"
+)
+
+func init() {
+	var (
+		T = gnet.CLIENT_TO_SERVER
+		R = gnet.SERVER_TO_CLIENT
+	)
+
+	// session setup
+	gnet.Register("Tconnect", T, &gnet.Hello{}, "versioned hello, must be sent first")
+	gnet.Register("Rconnect", R, &gnet.Welcome{}, "hello accepted")
+	gnet.Register("Rreject", R, &gnet.Reject{}, "hello or login refused, server hangs up")
+	gnet.Register("Tlogin", T, &gnet.Login{}, "account password, sent right after Rconnect")
+	gnet.Register("Rlogin", R, "", "login accepted, the account's name")
+	gnet.Register("Rjoin", R, &Join{}, "answer to Tconnect: map, our object and the world around it")
+	gnet.Register("Tdisconnect", T, nil, "client went away")
+	gnet.Register("Rbye", R, "", "server is hanging up on purpose, don't reconnect")
+	gnet.Register("Tping", T, &gnet.Ping{}, "heartbeat")
+	gnet.Register("Rpong", R, &gnet.Ping{}, "heartbeat echo")
+
+	// world state
+	gnet.Register("Tloadmap", T, nil, "request the map")
+	gnet.Register("Rloadmap", R, &MapChunk{}, "the map")
+	gnet.Register("Tgetplayer", T, nil, "request the id of the object we control")
+	gnet.Register("Rgetplayer", R, 0, "id of the object we control")
+	gnet.Register("Rsnapshot", R, &Snapshot{}, "changes since the last state the client acked")
+	gnet.Register("Tack", T, uint64(0), "client has the state with this snapshot seq")
+	gnet.Register("Tcamera", T, &Camera{}, "where a spectator is looking")
+
+	// gameplay
+	gnet.Register("Taction", T, &Input{}, "numbered movement or item action")
+	gnet.Register("Tchat", T, "", "chat line")
+	gnet.Register("Rchat", R, "", "text to show the player")
+	gnet.Register("Rerror", R, "", "a request failed")
+}
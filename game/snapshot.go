@@ -0,0 +1,274 @@
+// Snapshots: the world as one client last saw it, and the deltas that
+// bring it up to date. the server diffs against whatever state the
+// client acknowledged last, so lost or skipped snapshots don't matter.
+package game
+
+import (
+	"encoding/gob"
+	"fmt"
+	"github.com/nsf/termbox-go"
+	"image"
+	"time"
+)
+
+func init() {
+	gob.Register(&Snapshot{})
+}
+
+// which fields of an ObjectDelta are set
+type DeltaField uint8
+
+const (
+	DELTA_POS     DeltaField = 1 << iota // position changed
+	DELTA_GLYPH                          // glyph changed
+	DELTA_TAGS                           // some tags other than visible changed
+	DELTA_VISIBLE                        // the visible tag changed
+	DELTA_REMOVED                        // object is gone
+	DELTA_NAME                           // new or renamed object, has its name
+)
+
+// ObjectState is what a client can know about an object.
+// never changed once it is part of a WorldState.
+type ObjectState struct {
+	Name  string
+	Pos   image.Point
+	Glyph termbox.Cell
+	Tags  map[string]bool
+}
+
+func NewObjectState(gob *GameObject) *ObjectState {
+	c := gob.Copy()
+	return &ObjectState{Name: c.Name, Pos: c.Pos, Glyph: c.Glyph, Tags: c.Tags}
+}
+
+// WorldState is every object a client knows about, by id
+type WorldState map[int]*ObjectState
+
+// ObjectDelta holds the changes to one object
+type ObjectDelta struct {
+	ID      int
+	Fields  DeltaField
+	Name    string `json:",omitempty"`
+	Pos     image.Point
+	Glyph   termbox.Cell
+	Tags    map[string]bool `json:",omitempty"` // changed tags, without visible
+	Visible bool            `json:",omitempty"`
+}
+
+func (od ObjectDelta) String() string {
+	return fmt.Sprintf("%d:%02x", od.ID, od.Fields)
+}
+
+// Snapshot brings a client from the state it had at Base to the state at Seq
+type Snapshot struct {
+	Seq      uint64         // counts up from 1 on each connection
+	Base     uint64         // state the deltas apply to, 0 is the empty world
+	Deltas   []*ObjectDelta // changed objects
+	InputAck uint32         // last Input the server ran for this client
+	Time     time.Duration  // server clock of the state: ticks run times the tick interval
+}
+
+func (s Snapshot) String() string {
+	return fmt.Sprintf("seq %d base %d input %d, %d deltas", s.Seq, s.Base, s.InputAck, len(s.Deltas))
+}
+
+// the delta turning old into cur. either may be nil.
+func diffObject(id int, old, cur *ObjectState) *ObjectDelta {
+	if old == cur {
+		return nil
+	}
+
+	if cur == nil {
+		return &ObjectDelta{ID: id, Fields: DELTA_REMOVED}
+	}
+
+	d := &ObjectDelta{ID: id}
+
+	if old == nil {
+		old = &ObjectState{}
+		d.Fields |= DELTA_NAME | DELTA_POS | DELTA_GLYPH
+	}
+
+	if cur.Name != old.Name {
+		d.Fields |= DELTA_NAME
+	}
+
+	if cur.Pos != old.Pos {
+		d.Fields |= DELTA_POS
+	}
+
+	if cur.Glyph != old.Glyph {
+		d.Fields |= DELTA_GLYPH
+	}
+
+	if cur.Tags["visible"] != old.Tags["visible"] {
+		d.Fields |= DELTA_VISIBLE
+	}
+
+	for tag, val := range cur.Tags {
+		if tag != "visible" && old.Tags[tag] != val {
+			if d.Tags == nil {
+				d.Tags = make(map[string]bool)
+			}
+			d.Tags[tag] = val
+		}
+	}
+
+	for tag, val := range old.Tags {
+		if _, ok := cur.Tags[tag]; !ok && tag != "visible" && val {
+			if d.Tags == nil {
+				d.Tags = make(map[string]bool)
+			}
+			d.Tags[tag] = false
+		}
+	}
+
+	if d.Tags != nil {
+		d.Fields |= DELTA_TAGS
+	}
+
+	if d.Fields == 0 {
+		return nil
+	}
+
+	if d.Fields&DELTA_NAME != 0 {
+		d.Name = cur.Name
+	}
+
+	if d.Fields&DELTA_POS != 0 {
+		d.Pos = cur.Pos
+	}
+
+	if d.Fields&DELTA_GLYPH != 0 {
+		d.Glyph = cur.Glyph
+	}
+
+	d.Visible = cur.Tags["visible"]
+
+	return d
+}
+
+// Diff returns the deltas that turn ws into cur
+func (ws WorldState) Diff(cur WorldState) []*ObjectDelta {
+	var deltas []*ObjectDelta
+
+	for id, st := range cur {
+		if d := diffObject(id, ws[id], st); d != nil {
+			deltas = append(deltas, d)
+		}
+	}
+
+	for id, st := range ws {
+		if _, ok := cur[id]; !ok {
+			deltas = append(deltas, diffObject(id, st, nil))
+		}
+	}
+
+	return deltas
+}
+
+// Apply returns a new state, ws with deltas applied. ws isn't changed.
+func (ws WorldState) Apply(deltas []*ObjectDelta) WorldState {
+	n := make(WorldState, len(ws))
+	for id, st := range ws {
+		n[id] = st
+	}
+
+	for _, d := range deltas {
+		if d.Fields&DELTA_REMOVED != 0 {
+			delete(n, d.ID)
+			continue
+		}
+
+		st := &ObjectState{Tags: make(map[string]bool)}
+		if old, ok := n[d.ID]; ok {
+			*st = *old
+			st.Tags = make(map[string]bool, len(old.Tags))
+			for tag, val := range old.Tags {
+				st.Tags[tag] = val
+			}
+		}
+
+		if d.Fields&DELTA_NAME != 0 {
+			st.Name = d.Name
+		}
+
+		if d.Fields&DELTA_POS != 0 {
+			st.Pos = d.Pos
+		}
+
+		if d.Fields&DELTA_GLYPH != 0 {
+			st.Glyph = d.Glyph
+		}
+
+		for tag, val := range d.Tags {
+			st.Tags[tag] = val
+		}
+
+		st.Tags["visible"] = d.Visible
+
+		n[d.ID] = st
+	}
+
+	return n
+}
+
+// SnapshotTracker is a client's side of snapshots: the states it acked,
+// which the server's snapshots are diffed against. Not safe for
+// concurrent use.
+type SnapshotTracker struct {
+	states map[uint64]WorldState // states we acked, by seq
+	seq    uint64                // the newest one
+}
+
+func NewSnapshotTracker() *SnapshotTracker {
+	t := &SnapshotTracker{}
+	t.Reset()
+	return t
+}
+
+// Reset forgets every state. the server starts each connection from the
+// empty world, state 0.
+func (t *SnapshotTracker) Reset() {
+	t.states = map[uint64]WorldState{0: WorldState{}}
+	t.seq = 0
+}
+
+// Apply brings the world up to snap, returning how it changed. ok is
+// false for a snapshot older than what we have, which needs no ack.
+func (t *SnapshotTracker) Apply(snap *Snapshot) (deltas []*ObjectDelta, ok bool, err error) {
+	if snap.Seq <= t.seq {
+		return nil, false, nil
+	}
+
+	base, ok := t.states[snap.Base]
+	if !ok {
+		// the server only diffs against states we acked, so this is a bug
+		return nil, false, fmt.Errorf("snapshot %d against unknown state %d", snap.Seq, snap.Base)
+	}
+
+	cur := base.Apply(snap.Deltas)
+	deltas = t.states[t.seq].Diff(cur)
+
+	// the server never goes back past a state we acked
+	for seq := range t.states {
+		if seq < snap.Base {
+			delete(t.states, seq)
+		}
+	}
+
+	t.states[snap.Seq] = cur
+	t.seq = snap.Seq
+
+	return deltas, true, nil
+}
+
+// Current is the newest state we have. Don't change it.
+func (t *SnapshotTracker) Current() WorldState {
+	return t.states[t.seq]
+}
+
+// Seq is the seq of the newest state we have
+func (t *SnapshotTracker) Seq() uint64 {
+	return t.seq
+}
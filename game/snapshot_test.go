@@ -0,0 +1,184 @@
+package game
+
+import (
+	"fmt"
+	"image"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// st makes an ObjectState with tags set, visible unless told otherwise
+func st(name string, x, y int, tags ...string) *ObjectState {
+	s := &ObjectState{Name: name, Pos: image.Pt(x, y), Tags: map[string]bool{"visible": true}}
+	for _, tag := range tags {
+		if tag == "-visible" {
+			s.Tags["visible"] = false
+		} else {
+			s.Tags[tag] = true
+		}
+	}
+
+	return s
+}
+
+// ws without false tags, which Apply keeps and Diff doesn't care about
+func normalize(ws WorldState) WorldState {
+	n := make(WorldState, len(ws))
+	for id, s := range ws {
+		c := *s
+		c.Tags = make(map[string]bool)
+		for tag, val := range s.Tags {
+			if val {
+				c.Tags[tag] = true
+			}
+		}
+		n[id] = &c
+	}
+
+	return n
+}
+
+// ws readably, for failures
+func dump(ws WorldState) string {
+	var objs []string
+	for id, s := range normalize(ws) {
+		var tags []string
+		for tag := range s.Tags {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+
+		objs = append(objs, fmt.Sprintf("%d:%s@%d,%d%v", id, s.Name, s.Pos.X, s.Pos.Y, tags))
+	}
+	sort.Strings(objs)
+
+	return "{" + strings.Join(objs, " ") + "}"
+}
+
+func TestDiffApply(t *testing.T) {
+	tests := []struct {
+		name   string
+		states []WorldState // each diffed against the one before, starting from nothing
+	}{
+		{"empty", []WorldState{{}}},
+		{"new objects", []WorldState{
+			{1: st("player", 1, 2, "player"), 2: st("flag", 3, 4, "gettable")},
+		}},
+		{"move", []WorldState{
+			{1: st("player", 1, 2)},
+			{1: st("player", 2, 2)},
+		}},
+		{"rename", []WorldState{
+			{1: st("player", 1, 2)},
+			{1: st("bob", 1, 2)},
+		}},
+		{"retag", []WorldState{
+			{1: st("flag", 1, 2, "gettable", "item")},
+			{1: st("flag", 1, 2, "item", "worlditem")},
+			{1: st("flag", 1, 2, "-visible")},
+			{1: st("flag", 1, 2, "gettable")},
+		}},
+		{"remove", []WorldState{
+			{1: st("player", 1, 2), 2: st("flag", 3, 4)},
+			{1: st("player", 1, 2)},
+			{},
+		}},
+		{"re-add", []WorldState{
+			{1: st("flag", 1, 2, "gettable")},
+			{},
+			{1: st("sword", 5, 6, "item")},
+		}},
+		{"everything at once", []WorldState{
+			{1: st("player", 1, 2, "player"), 2: st("flag", 3, 4, "gettable"), 3: st("block", 5, 5)},
+			{1: st("bob", 2, 2, "player"), 3: st("block", 5, 6, "-visible"), 4: st("sword", 0, 0)},
+		}},
+	}
+
+	for _, tt := range tests {
+		have := WorldState{}
+		for i, want := range tt.states {
+			deltas := have.Diff(want)
+			have = have.Apply(deltas)
+
+			if !reflect.DeepEqual(normalize(have), normalize(want)) {
+				t.Errorf("%s: state %d: Apply(Diff) = %s, want %s", tt.name, i, dump(have), dump(want))
+			}
+
+			if again := have.Diff(want); len(again) != 0 {
+				t.Errorf("%s: state %d: %d deltas left after Apply: %v", tt.name, i, len(again), again)
+			}
+		}
+	}
+}
+
+func TestDiffFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, cur *ObjectState
+		want     DeltaField
+	}{
+		{"same", st("a", 1, 1), st("a", 1, 1), 0},
+		{"new", nil, st("a", 1, 1), DELTA_NAME | DELTA_POS | DELTA_GLYPH},
+		{"removed", st("a", 1, 1), nil, DELTA_REMOVED},
+		{"renamed", st("a", 1, 1), st("b", 1, 1), DELTA_NAME},
+		{"moved", st("a", 1, 1), st("a", 1, 2), DELTA_POS},
+		{"hidden", st("a", 1, 1), st("a", 1, 1, "-visible"), DELTA_VISIBLE},
+		{"tagged", st("a", 1, 1), st("a", 1, 1, "item"), DELTA_TAGS},
+		{"untagged", st("a", 1, 1, "item"), st("a", 1, 1), DELTA_TAGS},
+	}
+
+	for _, tt := range tests {
+		var got DeltaField
+		if d := diffObject(1, tt.old, tt.cur); d != nil {
+			got = d.Fields
+		}
+
+		if tt.cur != nil && tt.old == nil {
+			// a new object may have a visible tag to tell about too
+			got &^= DELTA_VISIBLE
+		}
+
+		if got != tt.want {
+			t.Errorf("%s: fields %02x, want %02x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSnapshotTracker(t *testing.T) {
+	one := WorldState{1: st("player", 1, 1)}
+	two := WorldState{1: st("player", 2, 1)}
+
+	tests := []struct {
+		name    string
+		snap    *Snapshot
+		wantOK  bool
+		wantErr bool
+		want    WorldState // Current after
+	}{
+		{"first", &Snapshot{Seq: 1, Base: 0, Deltas: WorldState{}.Diff(one)}, true, false, one},
+		{"resent", &Snapshot{Seq: 1, Base: 0, Deltas: WorldState{}.Diff(one)}, false, false, one},
+		{"against an acked one", &Snapshot{Seq: 3, Base: 1, Deltas: one.Diff(two)}, true, false, two},
+		{"older", &Snapshot{Seq: 2, Base: 0, Deltas: WorldState{}.Diff(one)}, false, false, two},
+		{"against one we never had", &Snapshot{Seq: 4, Base: 2}, false, true, two},
+		{"against one the server moved past", &Snapshot{Seq: 5, Base: 0}, false, true, two},
+	}
+
+	tr := NewSnapshotTracker()
+	for _, tt := range tests {
+		_, ok, err := tr.Apply(tt.snap)
+		if ok != tt.wantOK || (err != nil) != tt.wantErr {
+			t.Errorf("%s: ok %t err %v, want ok %t err %t", tt.name, ok, err, tt.wantOK, tt.wantErr)
+		}
+
+		if got := tr.Current(); len(got.Diff(tt.want)) != 0 {
+			t.Errorf("%s: have %s, want %s", tt.name, dump(got), dump(tt.want))
+		}
+	}
+
+	tr.Reset()
+	if tr.Seq() != 0 || len(tr.Current()) != 0 {
+		t.Errorf("Reset left seq %d, %s", tr.Seq(), dump(tr.Current()))
+	}
+}
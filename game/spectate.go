@@ -0,0 +1,27 @@
+// Spectating: clients that watch instead of play have no player, and tell
+// the server where to look with Tcamera instead.
+package game
+
+import (
+	"encoding/gob"
+	"fmt"
+	"image"
+)
+
+func init() {
+	gob.Register(&Camera{})
+}
+
+// Camera is where a spectator is looking
+type Camera struct {
+	Pos    image.Point // center of the view
+	Follow int         // object to keep in the center instead, 0 for none
+}
+
+func (c Camera) String() string {
+	if c.Follow != 0 {
+		return fmt.Sprintf("(camera following %d)", c.Follow)
+	}
+
+	return fmt.Sprintf("(camera at %s)", c.Pos)
+}
@@ -0,0 +1,221 @@
+// replay: plays the client side of a server packet capture back at a
+// server, one connection per captured session, with the original timing.
+// Start a fresh server and point this at it to reproduce a bug.
+package main
+
+import (
+	"flag"
+	"github.com/mischief/goland/game/bot"
+	"github.com/mischief/goland/game/gnet"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	REPLAY_NAME    = "goland-replay"
+	REPLAY_VERSION = "0.1"
+)
+
+var (
+	capfile  = flag.String("capture", "capture.jsonl", "capture file to replay")
+	server   = flag.String("server", "127.0.0.1:61507", "server address")
+	password = flag.String("password", "replay", "password for every replayed account, captures don't keep them")
+	register = flag.Bool("register", true, "register the captured accounts, set false if the server has them")
+	speed    = flag.Float64("speed", 1, "replay speed, 2 is twice as fast, 0 is as fast as possible")
+	linger   = flag.Duration("linger", time.Second, "how long sessions stay connected after their last packet")
+	tags     = flag.String("tags", "", "comma separated tags to replay, everything by default")
+	skip     = flag.String("skip", "", "comma separated tags not to replay")
+	users    = flag.String("users", "", "comma separated users or session ids to replay, everyone by default")
+	verbose  = flag.Bool("v", false, "print what the server sends back")
+
+	// the replayer does these itself instead of sending the captured ones
+	handshake = map[string]bool{
+		"Tconnect": true,
+		"Tlogin":   true,
+		"Tping":    true,
+		"Tack":     true,
+	}
+)
+
+// what one captured connection sent
+type Session struct {
+	ID      string
+	User    string
+	Packets []*gnet.CaptureRecord
+}
+
+func split(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	return strings.Split(s, ",")
+}
+
+// the captured sessions, in the order they started, and when the capture did
+func ReadSessions(r io.Reader, filter *gnet.CaptureFilter) ([]*Session, time.Time, error) {
+	var sessions []*Session
+	var start time.Time
+
+	byid := make(map[string]*Session)
+	cr := gnet.NewCaptureReader(r, filter)
+
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, start, err
+		}
+
+		if rec.Dir != gnet.CAPTURE_IN {
+			continue
+		}
+
+		s, ok := byid[rec.Session]
+		if !ok {
+			s = &Session{ID: rec.Session}
+			byid[rec.Session] = s
+			sessions = append(sessions, s)
+		}
+
+		if s.User == "" {
+			s.User = rec.User
+		}
+
+		if start.IsZero() {
+			start = rec.Time
+		}
+
+		if !handshake[rec.Tag()] {
+			s.Packets = append(s.Packets, rec)
+		}
+	}
+
+	return sessions, start, nil
+}
+
+// sleep until offset into the capture, scaled by speed
+func waitUntil(begin time.Time, offset time.Duration) {
+	if *speed <= 0 {
+		return
+	}
+
+	at := begin.Add(time.Duration(float64(offset) / *speed))
+	if d := at.Sub(time.Now()); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// connect and log in as user, speaking jsonl
+func Connect(user string) (*bot.Bot, error) {
+	return bot.Dial(&bot.Config{
+		Server:   *server,
+		Username: user,
+		Password: *password,
+		Register: *register,
+		Codec:    "jsonl",
+		Name:     REPLAY_NAME,
+		Version:  REPLAY_VERSION,
+	})
+}
+
+// watch what happens to s until the server hangs up. the bot acks
+// snapshots and pings like a client would.
+func Receive(s *Session, b *bot.Bot) {
+	for ev := range b.Events() {
+		if *verbose && ev.Packet != nil {
+			log.Printf("replay: %s <- %s", s.User, ev.Packet)
+		}
+
+		if ev.Kind == bot.EVENT_BYE {
+			log.Printf("replay: %s: server said bye: %s", s.User, ev.Text)
+		}
+	}
+}
+
+// Replay plays s back, timed from begin as the capture was from start
+func Replay(s *Session, start, begin time.Time) {
+	if len(s.Packets) == 0 {
+		return
+	}
+
+	waitUntil(begin, s.Packets[0].Time.Sub(start))
+
+	b, err := Connect(s.User)
+	if err != nil {
+		log.Printf("replay: %s: can't connect: %s", s.User, err)
+		return
+	}
+	defer b.Close()
+
+	log.Printf("replay: %s: connected, replaying %d packets from session %s", s.User, len(s.Packets), s.ID)
+
+	go Receive(s, b)
+
+	for _, rec := range s.Packets {
+		p, err := rec.Decode()
+		if err != nil {
+			log.Printf("replay: %s: skipping %s: %s", s.User, rec, err)
+			continue
+		}
+
+		waitUntil(begin, rec.Time.Sub(start))
+
+		if *verbose {
+			log.Printf("replay: %s -> %s", s.User, p)
+		}
+
+		if err := b.Send(p); err != nil {
+			log.Printf("replay: %s: %s", s.User, err)
+			return
+		}
+	}
+
+	time.Sleep(*linger)
+
+	log.Printf("replay: %s: done", s.User)
+}
+
+func main() {
+	flag.Parse()
+
+	f, err := os.Open(*capfile)
+	if err != nil {
+		log.Fatalf("replay: %s", err)
+	}
+	defer f.Close()
+
+	sessions, start, err := ReadSessions(f, gnet.NewCaptureFilter(split(*tags), split(*skip), split(*users)))
+	if err != nil {
+		log.Fatalf("replay: %s: %s", *capfile, err)
+	}
+
+	if len(sessions) == 0 {
+		log.Fatalf("replay: nothing to replay in %s", *capfile)
+	}
+
+	log.Printf("replay: replaying %d sessions from %s to %s", len(sessions), *capfile, *server)
+
+	var wg sync.WaitGroup
+	begin := time.Now()
+
+	for _, s := range sessions {
+		if s.User == "" {
+			log.Printf("replay: session %s never said who it was, skipping", s.ID)
+			continue
+		}
+
+		wg.Add(1)
+		go func(s *Session) {
+			defer wg.Done()
+			Replay(s, start, begin)
+		}(s)
+	}
+
+	wg.Wait()
+}
@@ -8,6 +8,9 @@ local new = function(name, x, y)
   i.SetTag('visible', true)
   i.SetTag('gettable', true)
   i.SetTag('item', true)
+  -- the map's items belong to the world: a player who logs out with one
+  -- leaves it behind instead of taking it out of the game
+  i.SetTag('worlditem', true)
   return i
 end
 
@@ -33,6 +33,7 @@ score = {
 }
 
 scores = {}
+persist.keep('scores')
 
 collision.fns.scorepoint = function(o1, o2)
   if o2.GetTag('player') ~= true then
@@ -79,8 +80,7 @@ collision.fns.scorepoint = function(o1, o2)
       obj.SetTag("visible", true)
       obj.SetTag("gettable", true)
 
-      -- tell everyone the object changed
-      gs.SendPkStrAll("Raction", obj)
+      -- the next tick tells everyone the object changed
 
       -- give player a point
       pname = o2.GetName()
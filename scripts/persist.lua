@@ -0,0 +1,79 @@
+-- script state that survives a server restart
+--
+-- persist.keep('scores') saves the global table 'scores' with the world,
+-- and puts it back when the server loads the save. only tables, strings,
+-- numbers and booleans are kept.
+
+local kept = {}
+
+-- save the global called name with the world
+local keep = function(name)
+  for _, v in ipairs(kept) do
+    if v == name then
+      return
+    end
+  end
+
+  kept[#kept + 1] = name
+end
+
+-- lua source that rebuilds v, or nil if v can't be saved
+local serialize
+serialize = function(v)
+  local t = type(v)
+
+  if t == 'number' or t == 'boolean' then
+    return tostring(v)
+  elseif t == 'string' then
+    return string.format('%q', v)
+  elseif t == 'table' then
+    local parts = {}
+    for k, val in pairs(v) do
+      local ks, vs = serialize(k), serialize(val)
+      if ks ~= nil and vs ~= nil then
+        parts[#parts + 1] = '[' .. ks .. ']=' .. vs
+      end
+    end
+    return '{' .. table.concat(parts, ',') .. '}'
+  end
+
+  return nil
+end
+
+-- every kept global as one string, for the world save
+local save = function()
+  local state = {}
+  for _, name in ipairs(kept) do
+    state[name] = _G[name]
+  end
+
+  return serialize(state)
+end
+
+-- put back the globals in a string made by save
+local load = function(s)
+  local f, err = loadstring('return ' .. s)
+  if f == nil then
+    gs.LuaLog("persist: can't read saved state: %s", err)
+    return
+  end
+
+  -- it's only data, don't let it touch anything
+  setfenv(f, {})
+
+  local ok, state = pcall(f)
+  if not ok or type(state) ~= 'table' then
+    gs.LuaLog("persist: can't read saved state: %s", tostring(state))
+    return
+  end
+
+  for name, v in pairs(state) do
+    _G[name] = v
+  end
+end
+
+return {
+  keep = keep,
+  save = save,
+  load = load,
+}
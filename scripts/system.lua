@@ -10,14 +10,43 @@
 loot = require('loot')
 items = require('items')
 coll = require('collision')
+persist = require('persist')
 
 collide = coll.collide
 
+-- the server calls these to save and restore script state with the world,
+-- use persist.keep to add to it
+onsave = persist.save
+onload = persist.load
+
 -- load our only map..
 map = require('map1')
 
 map.load()
 
+-- define ontick(n) to run something on every server tick, n counts up from 1
+--function ontick(n)
+--end
+
+-- handlers[tag](cp) runs for each client packet with that tag before the
+-- server's own handler, which it replaces by returning true
+handlers = {}
+
+--handlers.Tchat = function(cp)
+--  if cp.Data == '/ping' then
+--    cp.ReplyPkStr('Rchat', 'pong!')
+--    return true
+--  end
+--end
+
+-- stages[name](cp) runs for every client packet if "lua:name" is in the
+-- pipeline in config.lua. returning false drops the packet.
+stages = {}
+
+--stages.nosecrets = function(cp)
+--  return not (cp.Tag == 'Tchat' and string.find(cp.Data, 'hunter2'))
+--end
+
 -- get a debug shell after loading
 if gs.Debug() == true then
   debug.debug()
@@ -0,0 +1,432 @@
+// Accounts: players log in with a password, and their characters are
+// kept on disk between sessions.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mischief/goland/game"
+	"golang.org/x/crypto/bcrypt"
+	"image"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_ACCOUNTS = "accounts.json"
+
+	// shortest password we let anyone register with
+	MIN_PASSWORD = 4
+
+	// failed logins from one address, or for one account, before we
+	// stop listening to it for a while
+	DEFAULT_LOGIN_FAILURES = 5
+	DEFAULT_LOGIN_WINDOW   = time.Minute
+)
+
+var (
+	ErrNoAccount     = errors.New("no such account, register first")
+	ErrBadPassword   = errors.New("wrong password")
+	ErrAccountExists = errors.New("account already exists")
+
+	// what clients are told instead of the two above, so they can't
+	// find out which names have accounts
+	ErrBadLogin = errors.New("invalid username or password")
+)
+
+// Character is what an account's player keeps between sessions
+type Character struct {
+	ID        int // the player's object ID
+	Pos       image.Point
+	Tags      map[string]bool
+	Inventory []*game.GameObject
+}
+
+type Account struct {
+	Name      string        // as registered. logins ignore case
+	Hash      []byte        // bcrypt hash of the password, salt included
+	Created   time.Time     // when it was registered
+	LastLogin time.Time     // when it last logged in
+	Logins    int           // times logged in
+	PlayTime  time.Duration // time its player spent in the world
+	Character *Character    // nil until its player first leaves the world
+}
+
+// AccountStore keeps every account in one json file, rewritten on change
+type AccountStore struct {
+	Path string
+
+	accounts map[string]*Account // by lowercased name
+	m        sync.Mutex
+
+	// checked against when there's no account, so a name nobody has
+	// takes as long to refuse as a wrong password
+	dummy []byte
+}
+
+// LoadAccounts reads the accounts in path. A missing file is an empty store.
+func LoadAccounts(path string) (*AccountStore, error) {
+	as := &AccountStore{Path: path, accounts: make(map[string]*Account)}
+
+	dummy, err := bcrypt.GenerateFromPassword([]byte("nobody has this account"), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	as.dummy = dummy
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Printf("LoadAccounts: %s doesn't exist, starting with no accounts", path)
+		return as, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var accounts []*Account
+	if err := json.Unmarshal(b, &accounts); err != nil {
+		return nil, fmt.Errorf("can't read accounts from %s: %s", path, err)
+	}
+
+	for _, a := range accounts {
+		as.accounts[strings.ToLower(a.Name)] = a
+	}
+
+	log.Printf("LoadAccounts: loaded %d accounts from %s", len(as.accounts), path)
+
+	return as, nil
+}
+
+// write every account out. call with as.m held.
+func (as *AccountStore) save() error {
+	accounts := make([]*Account, 0, len(as.accounts))
+	for _, a := range as.accounts {
+		accounts = append(accounts, a)
+	}
+
+	b, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(as.Path, b)
+}
+
+// checkPassword says why password won't do for a new account, if it won't
+func checkPassword(password string) error {
+	if len(password) < MIN_PASSWORD {
+		return fmt.Errorf("password must be at least %d characters", MIN_PASSWORD)
+	}
+
+	return nil
+}
+
+// Register makes a new account called name
+func (as *AccountStore) Register(name, password string) (*Account, error) {
+	if err := checkPassword(password); err != nil {
+		return nil, err
+	}
+
+	// slow on purpose, so don't hold the lock
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	as.m.Lock()
+	defer as.m.Unlock()
+
+	key := strings.ToLower(name)
+	if _, ok := as.accounts[key]; ok {
+		return nil, ErrAccountExists
+	}
+
+	now := time.Now()
+	a := &Account{Name: name, Hash: hash, Created: now, LastLogin: now, Logins: 1}
+	as.accounts[key] = a
+
+	if err := as.save(); err != nil {
+		delete(as.accounts, key)
+		return nil, fmt.Errorf("can't save account: %s", err)
+	}
+
+	log.Printf("AccountStore: Register: new account %s", name)
+
+	return a, nil
+}
+
+// Verify checks password against the account called name, without
+// counting it as a login
+func (as *AccountStore) Verify(name, password string) (*Account, error) {
+	key := strings.ToLower(name)
+
+	as.m.Lock()
+	a, ok := as.accounts[key]
+	if !ok {
+		as.m.Unlock()
+
+		// as slow as a wrong password
+		bcrypt.CompareHashAndPassword(as.dummy, []byte(password))
+		return nil, ErrNoAccount
+	}
+	hash := a.Hash
+	as.m.Unlock()
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return nil, ErrBadPassword
+	}
+
+	return a, nil
+}
+
+// Login checks password against the account called name
+func (as *AccountStore) Login(name, password string) (*Account, error) {
+	if _, err := as.Verify(name, password); err != nil {
+		return nil, err
+	}
+
+	return as.CountLogin(name)
+}
+
+// CountLogin notes that the account called name logged in, for logins
+// whose password was checked already
+func (as *AccountStore) CountLogin(name string) (*Account, error) {
+	as.m.Lock()
+	defer as.m.Unlock()
+
+	a, ok := as.accounts[strings.ToLower(name)]
+	if !ok {
+		return nil, ErrNoAccount
+	}
+
+	a.LastLogin = time.Now()
+	a.Logins++
+
+	if err := as.save(); err != nil {
+		log.Printf("AccountStore: CountLogin: %s", err)
+	}
+
+	return a, nil
+}
+
+// Character is the saved character of the account called name, or nil
+func (as *AccountStore) Character(name string) *Character {
+	as.m.Lock()
+	defer as.m.Unlock()
+
+	if a, ok := as.accounts[strings.ToLower(name)]; ok {
+		return a.Character
+	}
+
+	return nil
+}
+
+// MaxID is the highest object ID any character uses
+func (as *AccountStore) MaxID() int {
+	as.m.Lock()
+	defer as.m.Unlock()
+
+	max := 0
+	for _, a := range as.accounts {
+		if a.Character == nil {
+			continue
+		}
+
+		if a.Character.ID > max {
+			max = a.Character.ID
+		}
+
+		for _, item := range a.Character.Inventory {
+			if item.ID > max {
+				max = item.ID
+			}
+		}
+	}
+
+	return max
+}
+
+// SaveCharacter stores ch as the character of the account called name,
+// which played for played since it was last saved
+func (as *AccountStore) SaveCharacter(name string, ch *Character, played time.Duration) error {
+	as.m.Lock()
+	defer as.m.Unlock()
+
+	a, ok := as.accounts[strings.ToLower(name)]
+	if !ok {
+		return ErrNoAccount
+	}
+
+	a.Character = ch
+	a.PlayTime += played
+
+	return as.save()
+}
+
+// SaveCharacter writes ws's player to its account, for when it next logs in.
+// Only called from the router.
+func (gs *GameServer) SaveCharacter(ws *WorldSession) {
+	p, ok := ws.Player.(*game.GameObject)
+	if !ok {
+		return
+	}
+
+	pc := p.Copy()
+	ch := &Character{ID: pc.ID, Pos: pc.Pos, Tags: pc.Tags}
+
+	for sub := range pc.SubObjects.Chan() {
+		// the world's things are saved with the world
+		if item, ok := sub.(*game.GameObject); ok && !item.GetTag("worlditem") {
+			ch.Inventory = append(ch.Inventory, item.Copy())
+		}
+	}
+
+	now := time.Now()
+	if err := gs.Accounts.SaveCharacter(ws.Username, ch, now.Sub(ws.savedAt)); err != nil {
+		log.Printf("GameServer: SaveCharacter: %s: %s", ws.Username, err)
+		return
+	}
+
+	ws.savedAt = now
+}
+
+// RestoreCharacter puts a saved character back into the world as p,
+// inventory and all. p must not be in the world yet. Only called from
+// the router.
+func (gs *GameServer) RestoreCharacter(p game.Object, ch *Character) {
+	gs.restoreID(p, ch.ID)
+
+	// the map may have changed under it since
+	if gs.Map.CheckCollision(nil, ch.Pos) {
+		p.SetPos(ch.Pos.X, ch.Pos.Y)
+	}
+
+	for tag, val := range ch.Tags {
+		p.SetTag(tag, val)
+	}
+
+	for _, saved := range ch.Inventory {
+		// saves from before world items stayed in the world. the world
+		// has its own copy.
+		if saved.Tags["worlditem"] {
+			continue
+		}
+
+		// a crash may have left it in the world save too. the copy in our
+		// pocket wins over one on the ground, not over one someone else
+		// picked up since.
+		if old := gs.Objects.FindObjectByID(saved.ID); old != nil {
+			if gs.carrierOf(saved.ID) != nil {
+				log.Printf("GameServer: RestoreCharacter: %s: someone else has %s now", p, old)
+				continue
+			}
+
+			gs.Objects.RemoveObject(old)
+		}
+
+		item := restoreObject(saved)
+		gs.restoreID(item, saved.ID)
+
+		// in our pocket, like Action_ItemPickup leaves it
+		item.SetTag("visible", false)
+		item.SetTag("gettable", false)
+
+		gs.Objects.Add(item)
+		p.AddSubObject(item)
+	}
+}
+
+// LoginThrottle counts failed logins by address and by account. Once
+// either has too many in the window, logins from it are refused until
+// the oldest failure is out of the window, so guessing passwords is slow
+// however many names or addresses are used.
+type LoginThrottle struct {
+	Max    int           // failures allowed in Window
+	Window time.Duration // how long a failure counts
+
+	failures map[string][]time.Time // by "addr " or "user " key
+	m        sync.Mutex
+}
+
+func NewLoginThrottle(max int, window time.Duration) *LoginThrottle {
+	return &LoginThrottle{Max: max, Window: window, failures: make(map[string][]time.Time)}
+}
+
+func throttleKeys(addr, name string) []string {
+	return []string{"addr " + addr, "user " + strings.ToLower(name)}
+}
+
+// the failures of key still in the window. call with lt.m held.
+func (lt *LoginThrottle) recent(key string, now time.Time) []time.Time {
+	f := lt.failures[key]
+	for len(f) > 0 && now.Sub(f[0]) > lt.Window {
+		f = f[1:]
+	}
+
+	if len(f) == 0 {
+		delete(lt.failures, key)
+	} else {
+		lt.failures[key] = f
+	}
+
+	return f
+}
+
+// Allow reports whether name may try to log in from addr, and if not,
+// how long until it may
+func (lt *LoginThrottle) Allow(addr, name string) (time.Duration, bool) {
+	lt.m.Lock()
+	defer lt.m.Unlock()
+
+	now := time.Now()
+
+	var wait time.Duration
+	for _, key := range throttleKeys(addr, name) {
+		if f := lt.recent(key, now); len(f) >= lt.Max {
+			if w := f[0].Add(lt.Window).Sub(now); w > wait {
+				wait = w
+			}
+		}
+	}
+
+	return wait, wait == 0
+}
+
+// Failed counts a failed login for name from addr
+func (lt *LoginThrottle) Failed(addr, name string) {
+	lt.m.Lock()
+	defer lt.m.Unlock()
+
+	now := time.Now()
+	for _, key := range throttleKeys(addr, name) {
+		lt.failures[key] = append(lt.recent(key, now), now)
+	}
+}
+
+// Succeeded forgets name's failures. its address keeps them, or one
+// account of its own would let it guess at everyone else's.
+func (lt *LoginThrottle) Succeeded(name string) {
+	lt.m.Lock()
+	defer lt.m.Unlock()
+
+	delete(lt.failures, "user "+strings.ToLower(name))
+}
+
+// the host part of addr, so every connection from it counts together
+func hostOf(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
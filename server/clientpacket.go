@@ -3,7 +3,6 @@ package main
 import (
 	"fmt"
 	"github.com/mischief/goland/game/gnet"
-	"log"
 )
 
 type ClientPacket struct {
@@ -16,13 +15,10 @@ func (cp ClientPacket) String() string {
 }
 
 func (cp *ClientPacket) Reply(pk *gnet.Packet) {
-	log.Printf("ClientPacket: Reply: %s -> %s %s", cp.Packet, cp.Client.Con.RemoteAddr(), pk)
-
-	defer func() {
-		if err := recover(); err != nil {
-			log.Printf("ClientPacket: Reply: error: %s", err)
-		}
-	}()
+	cp.Client.SendPacket(pk)
+}
 
-	cp.Client.ClientWChan <- pk
+// reply with a new packet, for scripts that can't make one
+func (cp *ClientPacket) ReplyPkStr(tag string, data interface{}) {
+	cp.Reply(gnet.NewPacket(tag, data))
 }
@@ -6,6 +6,101 @@ config = {
   -- listen dialstring
   listener    = "127.0.0.1:61507",
 
+  -- websocket gateway for browsers, and where its web page lives.
+  -- comment out websocket to disable it.
+  websocket   = "127.0.0.1:61508",
+  wwwroot     = "www",
+
+  -- ssh gateway: plays the game on each ssh session's terminal.
+  -- ssh logins are game accounts, and new names are registered.
+  -- uncomment ssh to enable it.
+  --ssh        = "0.0.0.0:61522",
+  sshhostkey = "ssh_host_key",
+
+  -- accounts and their saved characters
+  accounts    = "accounts.json",
+
+  -- after loginfailures wrong passwords in loginwindow seconds, from one
+  -- address or for one account, its logins are refused until they age out
+  loginfailures = 5,
+  loginwindow   = 60,
+
+  -- the world is saved here every autosave seconds, 0 for never,
+  -- and loaded from it on startup. delete it to start over.
+  worldsave   = "world.json",
+  autosave    = 300,
+
+  -- record each match here, for the client's -replay. scripts may call
+  -- gs.StartMatch(name) and gs.EndMatch() to split them up, otherwise a
+  -- match lasts as long as the server. comment out to not record.
+  matchdir    = "matches",
+
+  -- on SIGINT or SIGTERM players get shutdowndelay seconds of warning,
+  -- then the world is saved unless saveonexit is false.
+  -- a second signal skips the countdown.
+  shutdowndelay = 10,
+  saveonexit    = true,
+
+  -- let clients watch without a player, with -spectate
+  spectators  = true,
+
+  -- seconds a dropped player waits for its client to reconnect
+  resumegrace = 30,
+
+  -- seconds without any packet, even a ping, before we hang up on
+  -- clients that ping, and on those that don't, and seconds with nothing
+  -- but pings before a player is kicked as idle
+  readtimeout     = 30,
+  deadpeertimeout = 1800,
+  idletimeout     = 600,
+
+  -- packets each client may have waiting to be sent, and what to do when
+  -- a slow client fills that up: "drop" old position updates, "coalesce"
+  -- updates to the same object and drop if still full, or "disconnect"
+  sendqueue   = 256,
+  sendpolicy  = "coalesce",
+
+  -- stages client packets pass through on the way to the game, in order.
+  -- see Stages in pipeline.go for what there is, add "log" to write every
+  -- packet to the logfile. "lua:name" runs stages.name(cp) from the
+  -- scripts, which drops the packet by returning false. scripts can handle
+  -- packets too, see handlers in system.lua.
+  pipeline    = { "validate", "auth", "limiter", "metrics" },
+
+  -- seconds between logging packet counts, 0 for never
+  metricsinterval = 60,
+
+  -- record packets both ways to this jsonl file, for the replay tool.
+  -- capturetags keeps only those tags, captureskip drops those, and
+  -- captureusers keeps only those accounts or session ids.
+  --capture      = "capture.jsonl",
+  capturetags  = {},
+  captureskip  = { "Tping", "Rpong", "Tack" },
+  captureusers = {},
+
+  -- packets per second each client may send, and how many at once, by tag.
+  -- default covers the rest. packets over the limit are dropped, and a client
+  -- that goes over ratestrikes times in ratewindow seconds is kicked and
+  -- can't log in for rateban seconds (0 to only kick).
+  ratelimit   = {
+    default = { rate = 20, burst = 40 },
+    Taction = { rate = 40, burst = 80 },
+    Tchat   = { rate = 1,  burst = 5 },
+    Tcamera = { rate = 30, burst = 60 },
+    Tping   = { rate = 2,  burst = 10 },
+    Tack    = { rate = 60, burst = 120 },
+  },
+  ratestrikes = 50,
+  ratewindow  = 10,
+  rateban     = 300,
+
+  -- simulation ticks per second. actions take effect on the next tick.
+  tickrate    = 10,
+
+  -- clients see objects this many cells around their player.
+  -- 0 sends everyone the whole world.
+  aoiradius   = 48,
+
   -- logging & debugging
   logfile     = "server.log",
 
@@ -15,9 +15,38 @@ import (
 	"log"
 	"net"
 	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SERVER_NAME    = "goland-server"
+	SERVER_VERSION = "0.1"
 )
 
 var (
+	// optional protocol features this server can enable for a session
+	Features = map[string]bool{
+		"resume": true, // reconnect to the same player after a drop
+		"ping":   true, // Tping/Rpong heartbeats
+
+		// watch without a player, see spectate.go. set by 'spectators' in the config.
+		"spectate": true,
+	}
+
+	// handlers for packets arriving from clients, by tag.
+	// payloads are validated against the gnet registry before these run.
+	PacketHandlers = map[string]func(*GameServer, *ClientPacket) error{
+		"Tconnect":    (*GameServer).HandleConnectPacket,
+		"Tdisconnect": (*GameServer).HandleDisconnectPacket,
+		"Tchat":       (*GameServer).HandleChatPacket,
+		"Taction":     (*GameServer).HandleActionPacket,
+		"Tgetplayer":  (*GameServer).HandleGetPlayerPacket,
+		"Tloadmap":    (*GameServer).HandleLoadMapPacket,
+		"Tcamera":     (*GameServer).HandleCameraPacket,
+	}
+
 	Actions = map[game.Action]func(*GameServer, *ClientPacket){
 		game.ACTION_ITEM_PICKUP:         Action_ItemPickup,
 		game.ACTION_ITEM_DROP:           Action_ItemDrop,
@@ -30,8 +59,21 @@ var (
 type GameServer struct {
 	flow.Graph // graph for our procs; see goflow
 
-	Listener   net.Listener       // acceptor of client connections
-	PacketChan chan *ClientPacket // channel where clients packets arrive
+	Listener   net.Listener        // acceptor of client connections
+	Listeners  []net.Listener      // the gateways' acceptors, closed on shutdown
+	PacketChan chan *ClientPacket  // channel where clients packets arrive, see Post
+	Metrics    *PacketMetrics      // what the pipeline let through and dropped
+	Capture    *gnet.CaptureWriter // where packets are recorded, nil if they aren't
+
+	inClosed bool         // PacketChan is closed
+	inm      sync.RWMutex // protects the above
+
+	ShutdownDelay time.Duration // how long players are warned before shutdown
+	SaveOnExit    bool          // save the world on shutdown
+	quit          chan struct{} // closed when shutdown starts
+	hurry         chan struct{} // closed to cut the countdown short
+	stopTick      chan struct{} // closed to stop Ticker
+	stopped       chan struct{} // closed when shutdown is done
 
 	*game.DefaultSubject
 
@@ -39,10 +81,45 @@ type GameServer struct {
 
 	Objects *game.GameObjectMap
 	Map     *game.MapChunk
+	IDs     *game.IDAllocator // every object's ID comes from here
+
+	Accounts   *AccountStore            // who may log in, and their characters
+	Bans       *BanList                 // who may not, for now
+	RateLimits *RateLimits              // how fast clients may send
+	Logins     *LoginThrottle           // who's guessing passwords
+	Online     map[string]*WorldSession // sessions with a player, by username
+
+	Spectators map[*WorldSession]bool // sessions watching without a player
+
+	Resumable   map[string]*WorldSession // sessions by resume token
+	ResumeGrace time.Duration            // how long dropped players stay parked
+
+	ReadTimeout time.Duration // hang up on sessions silent this long
+	DeadPeer    time.Duration // or this long, without "ping"
+	IdleTimeout time.Duration // kick sessions that only ping this long
+
+	SendQueueMax int            // packets a session may have waiting
+	SendPolicy   OverflowPolicy // what to do when that is exceeded
+
+	TickChan     chan time.Time  // drives the router's simulation tick
+	TickInterval time.Duration   // fixed time step of the simulation
+	TickCount    uint64          // ticks run so far
+	Intents      []*ClientPacket // Tactions waiting for the next tick
+	State        game.WorldState // what clients can see, as of the last tick
+	AOIRadius    int             // how far clients see, 0 for everything
+	tickfn       *luar.LuaObject // lua's ontick, if there is one
+
+	SaveFile      string // where the world is saved
+	AutosaveEvery uint64 // ticks between saves, 0 for never
+
+	Match    *MatchRecorder // the match being recorded
+	MatchDir string         // where match files go, "" to not record
 
 	config *gutil.LuaConfig
 
-	Lua *lua.State
+	Lua       *lua.State
+	luam      sync.Mutex // lua runs one thing at a time: the router, or a lua stage
+	luaStages []string   // functions in the stages table the pipeline calls
 }
 
 func NewGameServer(config *gutil.LuaConfig, ls *lua.State) (*GameServer, error) {
@@ -54,26 +131,115 @@ func NewGameServer(config *gutil.LuaConfig, ls *lua.State) (*GameServer, error)
 
 	gs.InitGraphState()
 
-	// add nodes
+	// stages count what they drop here
+	gs.Metrics = NewPacketMetrics()
+
+	// add nodes. packets come in through the pipeline, see pipeline.go
 	gs.Add(NewPacketRouter(gs), "router")
-	gs.Add(new(PacketLogger), "logger")
 
-	// connect processes
-	// Used to be this, was throwing an error about too many arguments to gs.Graph.Connect:
-	// gs.Connect("router", "Log", "logger", "In", make(chan *ClientPacket))
-	gs.Connect("router", "Log", "logger", "In")
+	if err := gs.BuildPipeline(); err != nil {
+		return nil, err
+	}
 
 	// map external ports
-	gs.MapInPort("In", "router", "In")
+	gs.MapInPort("Tick", "router", "Tick")
 
 	gs.PacketChan = make(chan *ClientPacket, 5)
 	gs.SetInPort("In", gs.PacketChan)
 
+	gs.TickChan = make(chan time.Time)
+	gs.SetInPort("Tick", gs.TickChan)
+
+	// shutdown setup
+	gs.quit = make(chan struct{})
+	gs.hurry = make(chan struct{})
+	gs.stopTick = make(chan struct{})
+	gs.stopped = make(chan struct{})
+	gs.ShutdownDelay = gs.configDuration("shutdowndelay", DEFAULT_SHUTDOWN_DELAY)
+	gs.SaveOnExit = gs.configBool("saveonexit", true)
+
 	// observers setup
 	gs.DefaultSubject = game.NewDefaultSubject()
 
 	// objects setup
 	gs.Objects = game.NewGameObjectMap()
+	gs.State = game.WorldState{}
+
+	// account setup
+	accounts, err := LoadAccounts(gs.configString("accounts", DEFAULT_ACCOUNTS))
+	if err != nil {
+		return nil, err
+	}
+
+	gs.Accounts = accounts
+	gs.Online = make(map[string]*WorldSession)
+	gs.Bans = NewBanList()
+	gs.RateLimits = LoadRateLimits(gs)
+	gs.Logins = NewLoginThrottle(gs.configInt("loginfailures", DEFAULT_LOGIN_FAILURES), gs.configDuration("loginwindow", DEFAULT_LOGIN_WINDOW))
+
+	// spectator setup
+	gs.Spectators = make(map[*WorldSession]bool)
+	Features["spectate"] = gs.configBool("spectators", true)
+
+	// ids setup. the world save reserves its own in LoadWorld.
+	gs.IDs = game.NewIDAllocator(1)
+	gs.IDs.Reserve(accounts.MaxID())
+	game.IDs = gs.IDs
+
+	// session resume setup
+	gs.Resumable = make(map[string]*WorldSession)
+	gs.ResumeGrace = gs.configDuration("resumegrace", DEFAULT_RESUME_GRACE)
+
+	// heartbeat setup
+	gs.ReadTimeout = gs.configDuration("readtimeout", DEFAULT_READ_TIMEOUT)
+	gs.DeadPeer = gs.configDuration("deadpeertimeout", DEFAULT_DEAD_PEER_TIMEOUT)
+	gs.IdleTimeout = gs.configDuration("idletimeout", DEFAULT_IDLE_TIMEOUT)
+
+	// simulation setup
+	rate := gs.configInt("tickrate", DEFAULT_TICK_RATE)
+	if rate <= 0 || rate > int(time.Second) {
+		log.Printf("GameServer: 'tickrate' of %d makes no sense. defaulting to %d", rate, DEFAULT_TICK_RATE)
+		rate = DEFAULT_TICK_RATE
+	}
+	gs.TickInterval = time.Second / time.Duration(rate)
+	gs.AOIRadius = gs.configInt("aoiradius", DEFAULT_AOI_RADIUS)
+
+	// world save setup
+	gs.SaveFile = gs.configString("worldsave", DEFAULT_SAVE_FILE)
+	gs.AutosaveEvery = uint64(gs.configDuration("autosave", DEFAULT_AUTOSAVE) / gs.TickInterval)
+
+	// send queue setup
+	gs.SendQueueMax = gs.configInt("sendqueue", DEFAULT_SEND_QUEUE)
+	if gs.SendQueueMax <= 0 {
+		log.Printf("GameServer: 'sendqueue' of %d makes no sense. defaulting to %d", gs.SendQueueMax, DEFAULT_SEND_QUEUE)
+		gs.SendQueueMax = DEFAULT_SEND_QUEUE
+	}
+	policy := gs.configString("sendpolicy", DEFAULT_SEND_POLICY.String())
+	if p, ok := OverflowPolicies[policy]; ok {
+		gs.SendPolicy = p
+	} else {
+		log.Printf("GameServer: unknown sendpolicy %q. defaulting to %s", policy, DEFAULT_SEND_POLICY)
+		gs.SendPolicy = DEFAULT_SEND_POLICY
+	}
+
+	// match recording setup, started with the server
+	gs.Match = new(MatchRecorder)
+	gs.MatchDir = gs.configString("matchdir", "")
+
+	// packet capture setup
+	if path := gs.configString("capture", ""); path != "" {
+		tags, _ := gs.configStrings("capturetags")
+		skip, _ := gs.configStrings("captureskip")
+		users, _ := gs.configStrings("captureusers")
+
+		capture, err := gnet.CreateCapture(path, gnet.NewCaptureFilter(tags, skip, users))
+		if err != nil {
+			return nil, fmt.Errorf("can't capture packets: %s", err)
+		}
+
+		log.Printf("GameServer: capturing packets to %s", path)
+		gs.Capture = capture
+	}
 
 	// lua state
 	gs.Lua = ls
@@ -90,35 +256,114 @@ func (gs *GameServer) Debug() bool {
 	}
 }
 
-func (gs *GameServer) Run() {
-	gs.Start()
+// get a string from the config, or def if it isn't there
+func (gs *GameServer) configString(key, def string) string {
+	if val, err := gs.config.Get(key, reflect.String); err != nil {
+		log.Printf("GameServer: '%s' not found in config. defaulting to %s", key, def)
+		return def
+	} else {
+		return val.(string)
+	}
+}
+
+// get a boolean from the config, or def
+func (gs *GameServer) configBool(key string, def bool) bool {
+	if val, err := gs.config.Get(key, reflect.Bool); err != nil {
+		log.Printf("GameServer: '%s' not found in config. defaulting to %t", key, def)
+		return def
+	} else {
+		return val.(bool)
+	}
+}
+
+// get a list of strings from the config, and whether it was there
+func (gs *GameServer) configStrings(key string) ([]string, bool) {
+	val, err := gs.config.Get(key, reflect.Slice)
+	if err != nil {
+		return nil, false
+	}
+
+	var strs []string
+	for _, v := range val.([]interface{}) {
+		if s, ok := v.(string); ok {
+			strs = append(strs, s)
+		} else {
+			log.Printf("GameServer: %s: ignoring %v, not a string", key, v)
+		}
+	}
+
+	return strs, true
+}
+
+// get an integer from the config, or def
+func (gs *GameServer) configInt(key string, def int) int {
+	if val, err := gs.config.Get(key, reflect.Float64); err != nil {
+		log.Printf("GameServer: '%s' not found in config. defaulting to %d", key, def)
+		return def
+	} else {
+		return int(val.(float64))
+	}
+}
+
+// get a number of seconds from the config as a duration, or def
+func (gs *GameServer) configDuration(key string, def time.Duration) time.Duration {
+	if val, err := gs.config.Get(key, reflect.Float64); err != nil {
+		log.Printf("GameServer: '%s' not found in config. defaulting to %s", key, def)
+		return def
+	} else {
+		return time.Duration(val.(float64) * float64(time.Second))
+	}
+}
+
+// Run serves clients until the server is shut down, or returns why it
+// couldn't start
+func (gs *GameServer) Run() error {
+	if err := gs.Start(); err != nil {
+		return err
+	}
+
+	go gs.HandleSignals()
 
 	for {
 		conn, err := gs.Listener.Accept()
 		if err != nil {
+			if gs.Closing() {
+				break
+			}
+
 			log.Println("GameServer: acceptor: ", err)
 			continue
 		}
 
 		ws := NewWorldSession(gs, conn)
-		gs.Attach(ws)
 
 		log.Printf("GameServer: New connection from %s", ws.Con.RemoteAddr())
 
 		go ws.ReceiveProc()
 	}
 
+	<-gs.stopped
+
 	gs.End()
+
+	return nil
 }
 
-func (gs *GameServer) Start() {
+// Start loads the world and starts listening. Nothing is running yet if
+// it returns an error.
+func (gs *GameServer) Start() error {
 	var err error
 
 	// load assets
 	log.Print("GameServer: Loading assets")
 	if gs.LoadAssets() != true {
-		log.Printf("GameServer: LoadAssets failed")
-		return
+		return fmt.Errorf("LoadAssets failed")
+	}
+
+	if gs.MatchDir != "" {
+		if err := gs.StartMatch(DEFAULT_MATCH_NAME); err != nil {
+			log.Printf("GameServer: can't record match: %s", err)
+		}
 	}
 
 	// setup tcp listener
@@ -134,16 +379,54 @@ func (gs *GameServer) Start() {
 	}
 
 	if gs.Listener, err = net.Listen("tcp", dialstr); err != nil {
-		log.Fatalf("GameServer: %s", err)
+		gs.EndMatch()
+		return err
 	}
 
+	// get rid of idle sessions
+	go gs.Reaper()
+
+	// start the clock
+	go gs.Ticker()
+
+	// say how much traffic we're getting now and then
+	go gs.ReportMetrics(gs.configDuration("metricsinterval", DEFAULT_METRICS_INTERVAL))
+
+	// browsers come in over websockets
+	gs.StartWebSocket()
+
+	// and terminals without a client over ssh
+	gs.StartSSH()
+
 	// setup goflow network
 	log.Print("GameServer: Starting flow")
 
 	flow.RunNet(gs)
+
+	return nil
 }
 
+// the router has stopped, save what needs saving
 func (gs *GameServer) End() {
+	if gs.SaveOnExit {
+		if err := gs.SaveWorld(); err != nil {
+			log.Printf("GameServer: End: %s", err)
+		}
+	}
+
+	// whoever didn't leave in time, and everyone parked
+	for _, ws := range gs.Online {
+		gs.SaveCharacter(ws)
+	}
+
+	gs.EndMatch()
+
+	if gs.Capture != nil {
+		log.Printf("GameServer: End: captured %d packets", gs.Capture.Count())
+		gs.Capture.Close()
+	}
+
+	log.Print("GameServer: End: bye")
 }
 
 func (gs *GameServer) LoadMap(file string) bool {
@@ -159,8 +442,7 @@ func (gs *GameServer) LoadMap(file string) bool {
 func (gs *GameServer) AddObject(obj game.Object) {
 	log.Printf("Adding object %s", obj)
 
-	// tell clients about new object
-	gs.SendPkStrAll("Rnewobject", obj)
+	// clients hear about it in the next snapshot
 	gs.Objects.Add(obj)
 }
 
@@ -194,6 +476,9 @@ func (gs *GameServer) BindLua() {
 
 // load everything from lua scripts
 func (gs *GameServer) LoadAssets() bool {
+	gs.luam.Lock()
+	defer gs.luam.Unlock()
+
 	gs.BindLua()
 
 	if err := gs.Lua.DoString("require('system')"); err != nil {
@@ -201,97 +486,266 @@ func (gs *GameServer) LoadAssets() bool {
 		return false
 	}
 
+	// scripts may define ontick(n) to run every tick
+	gs.tickfn = gs.luaFunc("ontick")
+
+	// the pipeline can't do without the stages it was built with
+	for _, name := range gs.luaStages {
+		if gs.luaTableFunc("stages", name) == nil {
+			log.Printf("GameServer: LoadAssets: pipeline stage %s%s needs stages.%s in the scripts", LUA_STAGE_PREFIX, name, name)
+			return false
+		}
+	}
+
+	// carry on where the last run left off
+	if err := gs.LoadWorld(); err != nil {
+		log.Printf("GameServer: LoadAssets: %s", err)
+		return false
+	}
+
 	return true
 }
 
+// the lua global function name, or nil if scripts didn't define it
+func (gs *GameServer) luaFunc(name string) *luar.LuaObject {
+	gs.Lua.GetGlobal(name)
+	defer gs.Lua.Pop(1)
+
+	if !gs.Lua.IsFunction(-1) {
+		return nil
+	}
+
+	return luar.NewLuaObjectFromName(gs.Lua, name)
+}
+
+// the function at table[key] in lua, or nil if there isn't one
+func (gs *GameServer) luaTableFunc(table, key string) *luar.LuaObject {
+	gs.Lua.GetGlobal(table)
+	defer gs.Lua.Pop(1)
+
+	if !gs.Lua.IsTable(-1) {
+		return nil
+	}
+
+	gs.Lua.GetField(-1, key)
+	defer gs.Lua.Pop(1)
+
+	if !gs.Lua.IsFunction(-1) {
+		return nil
+	}
+
+	return luar.NewLuaObjectFromName(gs.Lua, table+"."+key)
+}
+
+// the function at handlers[tag] in lua, or nil if there isn't one
+func (gs *GameServer) luaHandler(tag string) *luar.LuaObject {
+	return gs.luaTableFunc("handlers", tag)
+}
+
 func (gs *GameServer) SendPkStrAll(tag string, data interface{}) {
 	gs.SendPacketAll(gnet.NewPacket(tag, data))
 }
 
-// send a packet to all clients
+// send a packet to all clients. this only queues it, so slow clients
+// don't hold up the rest.
 func (gs *GameServer) SendPacketAll(pk *gnet.Packet) {
+	pk = snapshot(pk)
+
+	if msg, ok := pk.Data.(string); ok && pk.Tag == "Rchat" {
+		gs.Match.Chat(msg)
+	}
+
 	gs.DefaultSubject.Lock()
 	defer gs.DefaultSubject.Unlock()
 	for s := gs.DefaultSubject.Observers.Front(); s != nil; s = s.Next() {
-		s.Value.(*WorldSession).SendPacket(pk)
+		s.Value.(*WorldSession).enqueue(pk)
 	}
 }
 
+// validate a client packet and run its handler: the scripts' from the lua
+// handlers table first, then ours from PacketHandlers unless the script's
+// returned true. malformed packets are logged and answered with Rerror
+// instead of panicking.
 func (gs *GameServer) HandlePacket(cp *ClientPacket) {
+	h, ok := PacketHandlers[cp.Tag]
+	if !ok {
+		h = (*GameServer).HandleUnknownPacket
+	}
 
-	switch cp.Tag {
+	err := gnet.Call(cp.Packet, gnet.CLIENT_TO_SERVER, func(*gnet.Packet) error {
+		if handled, err := gs.HandleLuaPacket(cp); handled || err != nil {
+			return err
+		}
 
-	// Tchat: chat message from a client
-	case "Tchat":
-		// broadcast chat
-		chatline := cp.Data.(string)
-		gs.SendPacketAll(gnet.NewPacket("Rchat", fmt.Sprintf("[chat] %s: %s", cp.Client.Username, chatline)))
+		return h(gs, cp)
+	})
 
-		// Taction: movement request
-	case "Taction":
-		gs.HandleActionPacket(cp)
+	if err != nil {
+		log.Printf("GameServer: HandlePacket: %s: %s", cp, err)
+		gs.Metrics.Fail(cp.Tag)
+		cp.Reply(gnet.NewPacket("Rerror", err.Error()))
+	}
+}
 
-		// Tconnect: user establishes new connection
-	case "Tconnect":
-		username, ok := cp.Data.(string)
+// run handlers[cp.Tag](cp) if the scripts defined it. reports whether
+// the script handled the packet, so ours shouldn't.
+func (gs *GameServer) HandleLuaPacket(cp *ClientPacket) (bool, error) {
+	fn := gs.luaHandler(cp.Tag)
+	if fn == nil {
+		return false, nil
+	}
 
-		if !ok {
-			cp.Reply(gnet.NewPacket("Rerror", "invalid username or conversion failed"))
-			break
-		} else {
-			cp.Client.Username = username
-		}
+	res, err := fn.Call(cp)
+	if err != nil {
+		return false, fmt.Errorf("lua handler for %s: %s", cp.Tag, err)
+	}
 
-		// make new player for client
-		var newplayer game.Object
-		newplayer = game.NewGameObject(username)
-		newplayer.SetTag("player", true)
-		newplayer.SetTag("visible", true)
+	handled, _ := res.(bool)
+	return handled, nil
+}
+
+// registered packets we don't handle end up here
+func (gs *GameServer) HandleUnknownPacket(cp *ClientPacket) error {
+	return fmt.Errorf("no handler for packet %s", cp.Tag)
+}
 
-		// setting this lets players pick up other players, lol
-		//newplayer.SetTag("gettable", true)
-		newplayer.SetGlyph(game.GLYPH_HUMAN)
-		newplayer.SetPos(256/2, 256/2)
+// Tchat: chat message from a client
+func (gs *GameServer) HandleChatPacket(cp *ClientPacket) error {
+	chatline := cp.Data.(string)
 
-		// set the session's object
-		cp.Client.Player = newplayer
+	if strings.TrimSpace(chatline) == "/who" {
+		gs.Who(cp)
+		return nil
+	}
 
-		// put player object in world
-		gs.Objects.Add(newplayer)
+	// broadcast chat
+	gs.SendPacketAll(gnet.NewPacket("Rchat", fmt.Sprintf("[chat] %s: %s", cp.Client.Username, chatline)))
+	return nil
+}
 
-		// tell client about all other objects
-		for o := range gs.Objects.Chan() {
-			if o.GetID() != newplayer.GetID() {
-				cp.Reply(gnet.NewPacket("Rnewobject", o))
-			}
+// Tconnect: user establishes new connection
+func (gs *GameServer) HandleConnectPacket(cp *ClientPacket) error {
+	// the session has already validated the hello, logged in and set Username
+	username := cp.Client.Username
+	hello := cp.Data.(*gnet.Hello)
+
+	// watching, not playing. spectators don't resume or take over players.
+	if cp.Client.HasFeature("spectate") {
+		gs.Spectate(cp.Client)
+		return nil
+	}
+
+	// try to take back a player we dropped
+	if hello.ResumeToken != "" {
+		if err := gs.Resume(cp.Client, hello.ResumeToken); err != nil {
+			log.Printf("GameServer: HandleConnectPacket: %s can't resume: %s", username, err)
+			cp.Reply(gnet.NewPacket("Rchat", fmt.Sprintf("Couldn't resume your session: %s.", err)))
 		}
+	}
 
-		// tell all clients about the new player
-		gs.SendPacketAll(gnet.NewPacket("Rnewobject", newplayer))
+	// logged in twice: the new connection gets the player
+	if old, ok := gs.Online[username]; ok && cp.Client.Player == nil && old.Player != nil {
+		log.Printf("GameServer: HandleConnectPacket: %s logged in again", username)
+		gs.TakeOver(cp.Client, old, "You logged in from somewhere else.")
+	}
 
-		// greet our new player
-		cp.Reply(gnet.NewPacket("Rchat", "Welcome to Goland!"))
+	if cp.Client.ResumeToken != "" {
+		gs.Resumable[cp.Client.ResumeToken] = cp.Client
+	}
 
-	case "Tdisconnect":
-		// notify clients this player went away
-		Action_ItemDrop(gs, cp)
-		gs.Objects.RemoveObject(cp.Client.Player)
-		gs.Detach(cp.Client)
-		gs.SendPacketAll(gnet.NewPacket("Rdelobject", cp.Client.Player))
+	if cp.Client.Player != nil {
+		gs.Online[username] = cp.Client
 
-	case "Tgetplayer":
-		if cp.Client.Player != nil {
-			cp.Reply(gnet.NewPacket("Rgetplayer", cp.Client.Player.GetID()))
-		} else {
-			cp.Reply(gnet.NewPacket("Rerror", "nil Player in WorldSession"))
-		}
+		// resumed, the client starts from scratch
+		gs.Join(cp.Client)
+		cp.Reply(gnet.NewPacket("Rchat", "Welcome back to Goland!"))
+		return nil
+	}
+
+	// make new player for client
+	var newplayer game.Object
+	newplayer = game.NewGameObject(username)
+	newplayer.SetTag("player", true)
+	newplayer.SetTag("visible", true)
 
-	case "Tloadmap":
-		cp.Reply(gnet.NewPacket("Rloadmap", gs.Map))
+	// setting this lets players pick up other players, lol
+	//newplayer.SetTag("gettable", true)
+	newplayer.SetGlyph(game.GLYPH_HUMAN)
+	newplayer.SetPos(256/2, 256/2)
 
-	default:
-		log.Printf("GameServer: HandlePacket: unknown packet type %s", cp.Tag)
+	// pick up where we left off
+	if ch := gs.Accounts.Character(username); ch != nil {
+		gs.RestoreCharacter(newplayer, ch)
 	}
+
+	// set the session's object
+	cp.Client.Player = newplayer
+	cp.Client.savedAt = time.Now()
+	gs.Online[username] = cp.Client
+
+	// put player object in world. everyone else
+	// finds out about it from the next snapshot.
+	gs.Objects.Add(newplayer)
+
+	// tell the client about the world and where it is in it
+	gs.Join(cp.Client)
+
+	// greet our new player
+	cp.Reply(gnet.NewPacket("Rchat", "Welcome to Goland!"))
+	return nil
+}
+
+// Tdisconnect: client went away
+func (gs *GameServer) HandleDisconnectPacket(cp *ClientPacket) error {
+	gs.Detach(cp.Client)
+
+	if cp.Client.Spectator {
+		delete(gs.Spectators, cp.Client)
+	}
+
+	if cp.Client.Player == nil {
+		return nil
+	}
+
+	// give the client a chance to come back for its player,
+	// unless we threw it out
+	if cp.Client.ResumeToken != "" && !cp.Client.parked && !cp.Client.Kicked() {
+		gs.Park(cp.Client)
+		return nil
+	}
+
+	delete(gs.Resumable, cp.Client.ResumeToken)
+
+	if gs.Online[cp.Client.Username] == cp.Client {
+		delete(gs.Online, cp.Client.Username)
+	}
+
+	// the world's things stay here, the player takes the rest along
+	gs.DropWorldItems(cp.Client.Player)
+	gs.SaveCharacter(cp.Client)
+
+	// clients see this player go away in the next snapshot
+	for sub := range cp.Client.Player.GetSubObjects().Chan() {
+		gs.Objects.RemoveObject(sub)
+	}
+	gs.Objects.RemoveObject(cp.Client.Player)
+	return nil
+}
+
+// Tgetplayer: client wants the id of the object it controls
+func (gs *GameServer) HandleGetPlayerPacket(cp *ClientPacket) error {
+	if cp.Client.Player == nil {
+		return fmt.Errorf("nil Player in WorldSession")
+	}
+
+	cp.Reply(gnet.NewPacket("Rgetplayer", cp.Client.Player.GetID()))
+	return nil
+}
+
+// Tloadmap: client wants the map
+func (gs *GameServer) HandleLoadMapPacket(cp *ClientPacket) error {
+	cp.Reply(gnet.NewPacket("Rloadmap", gs.Map))
+	return nil
 }
 
 // Prevent User from re-adding / picking up item
@@ -299,12 +753,12 @@ func (gs *GameServer) HandlePacket(cp *ClientPacket) {
 func Action_ItemPickup(gs *GameServer, cp *ClientPacket) {
 	p := cp.Client.Player
 
-	// we assume our cp.Data is a game.Action of type ACTION_ITEM_PICKUP
+	// we assume our cp.Data is a game.Input of type ACTION_ITEM_PICKUP
 	// act accordingly
 
-	for o := range gs.Objects.Chan() {
-		// if same pos.. and gettable
-		if game.SamePos(o, p) && o.GetTag("gettable") {
+	for _, o := range gs.Objects.ObjectsAt(image.Pt(p.GetPos())) {
+		// if gettable
+		if o.GetTag("gettable") {
 			// pickup item.
 			log.Printf("GameServer: Action_ItemPickup: %s picking up %s", p, o)
 			o.SetTag("visible", false)
@@ -312,8 +766,6 @@ func Action_ItemPickup(gs *GameServer, cp *ClientPacket) {
 			o.SetPos(0, 0)
 			p.AddSubObject(o)
 
-			// update clients with the new state of this object
-			gs.SendPacketAll(gnet.NewPacket("Raction", o))
 			cp.Reply(gnet.NewPacket("Rchat", fmt.Sprintf("You pick up a %s.", o.GetName())))
 		}
 	}
@@ -334,12 +786,39 @@ func Action_ItemDrop(gs *GameServer, cp *ClientPacket) {
 		sub.SetTag("visible", true)
 		sub.SetTag("gettable", true)
 
-		// update clients with the new state of this object
-		gs.SendPacketAll(gnet.NewPacket("Raction", sub))
 		cp.Reply(gnet.NewPacket("Rchat", fmt.Sprintf("You drop a %s.", sub.GetName())))
 	}
 }
 
+// DropWorldItems puts down what p carries that belongs to the world, like
+// the flags, so it isn't taken out of the game with p. Only called from
+// the router.
+func (gs *GameServer) DropWorldItems(p game.Object) {
+	for sub := range p.GetSubObjects().Chan() {
+		if !sub.GetTag("worlditem") {
+			continue
+		}
+
+		log.Printf("GameServer: DropWorldItems: %s leaving %s behind", p, sub)
+
+		p.RemoveSubObject(sub)
+		sub.SetPos(p.GetPos())
+		sub.SetTag("visible", true)
+		sub.SetTag("gettable", true)
+	}
+}
+
+// the object carrying the object with id, or nil
+func (gs *GameServer) carrierOf(id int) game.Object {
+	for o := range gs.Objects.Chan() {
+		if subs := o.GetSubObjects(); subs != nil && subs.FindObjectByID(id) != nil {
+			return o
+		}
+	}
+
+	return nil
+}
+
 // List items in Player's inventory
 func Action_Inventory(gs *GameServer, cp *ClientPacket) {
 	plobj := cp.Client.Player
@@ -372,26 +851,47 @@ func Action_Inventory(gs *GameServer, cp *ClientPacket) {
 }
 
 // Top level handler for Taction packets
-func (gs *GameServer) HandleActionPacket(cp *ClientPacket) {
-	action := cp.Data.(game.Action)
+func (gs *GameServer) HandleActionPacket(cp *ClientPacket) error {
+	action := cp.Data.(*game.Input).Action
 	p := cp.Client.Player
 
+	if cp.Client.Spectator {
+		return fmt.Errorf("spectators can't act")
+	}
+
+	if p == nil {
+		return fmt.Errorf("nil Player in WorldSession")
+	}
+
 	_, isdir := game.DirTable[action]
-	if isdir {
+	_, isaction := Actions[action]
+
+	if !isdir && !isaction {
+		return fmt.Errorf("unknown action %d", action)
+	}
+
+	// actions happen on the next tick, in the order they arrived
+	gs.Intents = append(gs.Intents, cp)
+	return nil
+}
+
+// carry out a queued Taction. changed objects are sent at the end of the tick.
+func (gs *GameServer) RunAction(cp *ClientPacket) {
+	action := cp.Data.(*game.Input).Action
+
+	if _, isdir := game.DirTable[action]; isdir {
 		gs.HandleMovementPacket(cp)
 	}
 
 	// check if this action is in our Actions table, if so execute it
-	if f, ok := Actions[action]; ok {
+	if f, isaction := Actions[action]; isaction {
 		f(gs, cp)
 	}
-
-	gs.SendPacketAll(gnet.NewPacket("Raction", p))
 }
 
 // Handle Directionals
 func (gs *GameServer) HandleMovementPacket(cp *ClientPacket) {
-	action := cp.Data.(game.Action)
+	action := cp.Data.(*game.Input).Action
 	p := cp.Client.Player
 	offset := game.DirTable[action]
 	oldposx, oldposy := p.GetPos()
@@ -405,46 +905,39 @@ func (gs *GameServer) HandleMovementPacket(cp *ClientPacket) {
 	}
 
 	// check gameobject collision
-	for o := range gs.Objects.Chan() {
-
+	for _, o := range gs.Objects.ObjectsAt(newpos) {
 		// check if collision with Item and item name is flag
-		px, py := o.GetPos()
-		if px == newpos.X && py == newpos.Y {
-			collfn := luar.NewLuaObjectFromName(gs.Lua, "collide")
-			res, err := collfn.Call(p, o)
-			if err != nil {
-				log.Printf("GameServer: HandleMovementPacket: Lua error: %s", err)
-				return
-			}
+		collfn := luar.NewLuaObjectFromName(gs.Lua, "collide")
+		res, err := collfn.Call(p, o)
+		if err != nil {
+			log.Printf("GameServer: HandleMovementPacket: Lua error: %s", err)
+			return
+		}
 
-			// only update position if collide returns true
-			if thebool, ok := res.(bool); !ok || !thebool {
-				log.Printf("GameServer: HandleMovementPacket: Lua collision failed")
-				valid = false
-			} else {
-				// tell everyone that the colliders changed
-				gs.SendPacketAll(gnet.NewPacket("Raction", o))
-			}
+		// only update position if collide returns true
+		if thebool, ok := res.(bool); !ok || !thebool {
+			log.Printf("GameServer: HandleMovementPacket: Lua collision failed")
+			valid = false
+		}
 
-			if o.GetTag("player") {
-				cp.Reply(gnet.NewPacket("Rchat", fmt.Sprintf("Ouch! You bump into %s.", o.GetName())))
+		if o.GetTag("player") {
+			cp.Reply(gnet.NewPacket("Rchat", fmt.Sprintf("Ouch! You bump into %s.", o.GetName())))
 
-				// check if other player's got the goods
-				for sub := range o.GetSubObjects().Chan() {
-					if sub.GetTag("item") == true {
-						// swap pop'n'lock
+			// check if other player's got the goods
+			for sub := range o.GetSubObjects().Chan() {
+				if sub.GetTag("item") == true {
+					// swap pop'n'lock
 
-						// remove item from player
-						swap := o.RemoveSubObject(sub)
-						p.AddSubObject(swap)
-						cp.Reply(gnet.NewPacket("Rchat", fmt.Sprintf("You steal a %s!", swap.GetName())))
-					}
+					// remove item from player
+					swap := o.RemoveSubObject(sub)
+					p.AddSubObject(swap)
+					cp.Reply(gnet.NewPacket("Rchat", fmt.Sprintf("You steal a %s!", swap.GetName())))
 				}
 			}
+		}
 
-			if o.GetTag("item") && o.GetTag("gettable") && valid {
-				cp.Reply(gnet.NewPacket("Rchat", fmt.Sprintf("You see a %s here.", o.GetName())))
-			}
+		if o.GetTag("item") && o.GetTag("gettable") && valid {
+			cp.Reply(gnet.NewPacket("Rchat", fmt.Sprintf("You see a %s here.", o.GetName())))
 		}
 	}
 
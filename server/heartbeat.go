@@ -0,0 +1,69 @@
+// Heartbeat: answer client pings, and get rid of sessions that have
+// gone quiet or idle so broadcasts stop going to dead connections.
+package main
+
+import (
+	"github.com/mischief/goland/game/gnet"
+	"log"
+	"time"
+)
+
+const (
+	// a session that sends nothing, not even a ping, for this long is dead
+	DEFAULT_READ_TIMEOUT = 30 * time.Second
+
+	// same for sessions that didn't ask for "ping", which may be quiet for
+	// as long as they like, short of this
+	DEFAULT_DEAD_PEER_TIMEOUT = 30 * time.Minute
+
+	// a session that only pings for this long is kicked
+	DEFAULT_IDLE_TIMEOUT = 10 * time.Minute
+
+	// how often the reaper looks for idle sessions
+	REAP_INTERVAL = 5 * time.Second
+)
+
+// answer a Tping right away from the session's reader, so the round trip
+// doesn't depend on how busy the router is and pings don't fill the logs.
+func (ws *WorldSession) HandlePing(pk *gnet.Packet) error {
+	return gnet.Call(pk, gnet.CLIENT_TO_SERVER, func(pk *gnet.Packet) error {
+		ping := pk.Data.(*gnet.Ping)
+
+		ws.m.Lock()
+		ws.rtt = ping.RTT
+		ws.m.Unlock()
+
+		ws.SendPacket(gnet.NewPacket("Rpong", ping))
+		return nil
+	})
+}
+
+// Reaper kicks sessions that haven't done anything but ping for IdleTimeout.
+// Sessions that stop sending altogether hit their read deadline instead.
+// Spectators are left alone, watching is all they're here for.
+func (gs *GameServer) Reaper() {
+	for _ = range time.Tick(REAP_INTERVAL) {
+		var idle []*WorldSession
+
+		gs.DefaultSubject.Lock()
+		for s := gs.DefaultSubject.Observers.Front(); s != nil; s = s.Next() {
+			ws := s.Value.(*WorldSession)
+
+			// Features is fixed by the handshake, unlike Spectator which
+			// the router sets
+			if ws.HasFeature("spectate") {
+				continue
+			}
+
+			if ws.IdleFor() > gs.IdleTimeout {
+				idle = append(idle, ws)
+			}
+		}
+		gs.DefaultSubject.Unlock()
+
+		for _, ws := range idle {
+			log.Printf("GameServer: Reaper: %s idle for %s", ws, ws.IdleFor())
+			ws.Kick("You were idle for too long.")
+		}
+	}
+}
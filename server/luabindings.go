@@ -6,9 +6,30 @@ import (
 	"github.com/mischief/goland/game/gutil"
 	"github.com/nsf/termbox-go"
 	"github.com/stevedonovan/luar"
+	"image"
 	"unicode/utf8"
 )
 
+// positional queries for scripts, which can't make image.Points.
+// slices come back 1-indexed, so use 'for i = 1, #objs do'.
+
+// gs.ObjectsAt(x, y): objects at x, y
+func (gs *GameServer) ObjectsAt(x, y int) []game.Object {
+	return gs.Objects.ObjectsAt(image.Pt(x, y))
+}
+
+// gs.ObjectsInRect(x0, y0, x1, y1): objects with x0 <= x < x1 and y0 <= y < y1
+func (gs *GameServer) ObjectsInRect(x0, y0, x1, y1 int) []game.Object {
+	return gs.Objects.ObjectsInRect(image.Rect(x0, y0, x1, y1))
+}
+
+// gs.Nearest(x, y, tag): closest object to x, y with tag set, or any object if tag is ""
+func (gs *GameServer) Nearest(x, y int, tag string) game.Object {
+	return gs.Objects.Nearest(image.Pt(x, y), func(o game.Object) bool {
+		return tag == "" || o.GetTag(tag)
+	})
+}
+
 // make a new GameObject
 func LuaNewGameObject(name string) game.Object {
 	return game.NewGameObject(name)
@@ -82,8 +82,8 @@ func main() {
 	gs, err := NewGameServer(config, Lua)
 	if err != nil {
 		log.Println(err)
-	} else {
-		gs.Run()
+	} else if err := gs.Run(); err != nil {
+		log.Printf("main: can't start server: %s", err)
 	}
 
 	log.Println("main: Logging ended")
@@ -0,0 +1,145 @@
+// Match recording: every tick, whatever changed in the world and whatever
+// everyone was told goes to a match file, which the client's -replay mode
+// plays back. A match runs from StartMatch to EndMatch, which scripts may
+// call; one starts with the server if 'matchdir' is set.
+package main
+
+import (
+	"fmt"
+	"github.com/mischief/goland/game"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_MATCH_NAME = "match"
+)
+
+// MatchRecorder writes the match in progress, if there is one
+type MatchRecorder struct {
+	Path string // file being written, "" when not recording
+
+	w    *game.MatchWriter
+	last game.WorldState // as of the last frame
+	chat []string        // said since the last frame
+	m    sync.Mutex
+}
+
+// Recording reports whether a match is being recorded
+func (mr *MatchRecorder) Recording() bool {
+	mr.m.Lock()
+	defer mr.m.Unlock()
+
+	return mr.w != nil
+}
+
+// Chat notes that everyone was told msg
+func (mr *MatchRecorder) Chat(msg string) {
+	mr.m.Lock()
+	defer mr.m.Unlock()
+
+	if mr.w != nil {
+		mr.chat = append(mr.chat, msg)
+	}
+}
+
+// Record writes a frame for tick, if anything happened since the last one
+func (mr *MatchRecorder) Record(tick uint64, state game.WorldState) {
+	mr.m.Lock()
+	defer mr.m.Unlock()
+
+	if mr.w == nil {
+		return
+	}
+
+	f := &game.MatchFrame{Tick: tick, Deltas: mr.last.Diff(state), Chat: mr.chat}
+	if len(f.Deltas) == 0 && len(f.Chat) == 0 {
+		return
+	}
+
+	mr.last = state
+	mr.chat = nil
+
+	if err := mr.w.WriteFrame(f); err != nil {
+		log.Printf("MatchRecorder: Record: %s: %s, recording stopped", mr.Path, err)
+		mr.stop()
+	}
+}
+
+// close the file. call with mr.m held.
+func (mr *MatchRecorder) stop() {
+	if mr.w == nil {
+		return
+	}
+
+	if err := mr.w.Close(); err != nil {
+		log.Printf("MatchRecorder: %s: %s", mr.Path, err)
+	}
+
+	mr.w = nil
+	mr.last = nil
+	mr.chat = nil
+}
+
+// StartMatch starts recording a new match called name, ending the one in
+// progress. Only called from the router, or from lua.
+func (gs *GameServer) StartMatch(name string) error {
+	if gs.MatchDir == "" {
+		return fmt.Errorf("matches aren't recorded, set matchdir")
+	}
+
+	gs.EndMatch()
+
+	if err := os.MkdirAll(gs.MatchDir, 0755); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	path := filepath.Join(gs.MatchDir, fmt.Sprintf("%s-%s.jsonl", name, now.Format("20060102-150405")))
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	w, err := game.NewMatchWriter(f, &game.MatchHeader{
+		Version:   game.MATCH_VERSION,
+		Name:      name,
+		Started:   now,
+		TickRate:  int(time.Second / gs.TickInterval),
+		FirstTick: gs.TickCount,
+		Map:       gs.Map,
+	})
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	gs.Match.m.Lock()
+	gs.Match.Path = path
+	gs.Match.w = w
+	gs.Match.last = game.WorldState{}
+	gs.Match.m.Unlock()
+
+	log.Printf("GameServer: StartMatch: recording %s to %s", name, path)
+
+	return nil
+}
+
+// EndMatch stops recording the match in progress, if there is one
+func (gs *GameServer) EndMatch() {
+	gs.Match.m.Lock()
+	defer gs.Match.m.Unlock()
+
+	if gs.Match.w == nil {
+		return
+	}
+
+	log.Printf("GameServer: EndMatch: done recording %s", gs.Match.Path)
+
+	gs.Match.stop()
+	gs.Match.Path = ""
+}
@@ -1,4 +1,4 @@
-// PacketLogger: flow proc to log Packets
+// PacketLogger: pipeline stage to log Packets on their way to the router
 package main
 
 import (
@@ -8,9 +8,21 @@ import (
 
 type PacketLogger struct {
 	flow.Component
-	In <-chan *ClientPacket // channel of packets to log
+	In  <-chan *ClientPacket // channel of packets to log
+	Out chan<- *ClientPacket // and pass on
+}
+
+func NewPacketLogger() *PacketLogger {
+	l := new(PacketLogger)
+
+	// keep them in order
+	l.Component.Mode = flow.ComponentModeSync
+
+	return l
 }
 
 func (l *PacketLogger) OnIn(p *ClientPacket) {
 	log.Printf("PacketLogger: OnIn: %s", p)
+
+	l.Out <- p
 }
@@ -3,14 +3,15 @@ package main
 
 import (
 	"github.com/trustmaster/goflow"
+	"time"
 
 //	"log"
 )
 
 type PacketRouter struct {
 	flow.Component
-	In  <-chan *ClientPacket
-	Log chan<- *ClientPacket
+	In   <-chan *ClientPacket // from the end of the pipeline
+	Tick <-chan time.Time
 
 	world *GameServer
 }
@@ -18,6 +19,10 @@ type PacketRouter struct {
 func NewPacketRouter(w *GameServer) *PacketRouter {
 	pr := new(PacketRouter)
 
+	// one packet or tick at a time, so game state needs no locking
+	// and actions run in the order they arrived
+	pr.Component.Mode = flow.ComponentModeSync
+
 	pr.world = w
 
 	return pr
@@ -31,8 +36,8 @@ func (pr *PacketRouter) OnIn(p *ClientPacket) {
 		//}
 	}()
 
-	// log all packets
-	pr.Log <- p
+	pr.world.luam.Lock()
+	defer pr.world.luam.Unlock()
 
 	pr.world.HandlePacket(p)
 
@@ -46,3 +51,10 @@ func (pr *PacketRouter) OnIn(p *ClientPacket) {
 		}
 	*/
 }
+
+func (pr *PacketRouter) OnTick(t time.Time) {
+	pr.world.luam.Lock()
+	defer pr.world.luam.Unlock()
+
+	pr.world.Tick()
+}
@@ -0,0 +1,356 @@
+// Pipeline: client packets pass through a chain of flow procs on their
+// way to the PacketRouter. Each stage has an In and an Out port and either
+// passes a packet on or drops it. The chain is built from 'pipeline' in the
+// config, so stages can be added, removed or reordered without touching
+// the router. Scripts add stages too: "lua:name" in the config runs
+// stages.name from the scripts.
+package main
+
+import (
+	"fmt"
+	"github.com/mischief/goland/game/gnet"
+	"github.com/trustmaster/goflow"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_METRICS_INTERVAL = time.Minute
+
+	// pipeline entries naming a function in the scripts' stages table
+	LUA_STAGE_PREFIX = "lua:"
+)
+
+// a StageFunc makes a pipeline stage, a flow proc with
+// In <-chan *ClientPacket and Out chan<- *ClientPacket ports
+type StageFunc func(gs *GameServer) interface{}
+
+var (
+	// pipeline stages by name, for 'pipeline' in the config.
+	// add your own with RegisterStage from an init func.
+	Stages = map[string]StageFunc{
+		"validate": func(gs *GameServer) interface{} { return NewValidator(gs) },
+		"auth":     func(gs *GameServer) interface{} { return NewAuthGate(gs) },
+		"limiter":  func(gs *GameServer) interface{} { return NewRateLimiter(gs) },
+		"metrics":  func(gs *GameServer) interface{} { return NewMetricsStage(gs) },
+		"log":      func(gs *GameServer) interface{} { return NewPacketLogger() },
+	}
+
+	// used if the config doesn't say
+	DefaultPipeline = []string{"validate", "auth", "limiter", "metrics"}
+)
+
+// RegisterStage makes a new stage available to the config
+func RegisterStage(name string, fn StageFunc) {
+	if _, ok := Stages[name]; ok {
+		panic(fmt.Sprintf("RegisterStage: stage %s already registered", name))
+	}
+
+	Stages[name] = fn
+}
+
+// the stage names from 'pipeline' in the config, or DefaultPipeline
+func (gs *GameServer) pipelineStages() []string {
+	names, ok := gs.configStrings("pipeline")
+	if !ok {
+		log.Printf("GameServer: 'pipeline' not found in config. defaulting to %s", strings.Join(DefaultPipeline, ", "))
+		return DefaultPipeline
+	}
+
+	return names
+}
+
+// BuildPipeline adds the configured stages to the graph, chained in order,
+// with the graph's In port at the front and the router at the end.
+func (gs *GameServer) BuildPipeline() error {
+	prev := ""
+	seen := make(map[string]bool)
+	names := gs.pipelineStages()
+
+	for _, name := range names {
+		fn, ok := Stages[name]
+
+		if fname := strings.TrimPrefix(name, LUA_STAGE_PREFIX); fname != name && fname != "" {
+			fn, ok = func(gs *GameServer) interface{} { return NewLuaStage(gs, fname) }, true
+			gs.luaStages = append(gs.luaStages, fname)
+		}
+
+		if !ok {
+			known := make([]string, 0, len(Stages))
+			for n := range Stages {
+				known = append(known, n)
+			}
+			sort.Strings(known)
+
+			return fmt.Errorf("unknown pipeline stage %q, have %s or %sname for a lua stage", name, strings.Join(known, ", "), LUA_STAGE_PREFIX)
+		}
+
+		if seen[name] {
+			return fmt.Errorf("pipeline stage %q listed twice", name)
+		}
+		seen[name] = true
+
+		gs.Add(fn(gs), name)
+
+		if prev == "" {
+			gs.MapInPort("In", name, "In")
+		} else {
+			gs.Connect(prev, "Out", name, "In")
+		}
+
+		prev = name
+	}
+
+	if prev == "" {
+		gs.MapInPort("In", "router", "In")
+	} else {
+		gs.Connect(prev, "Out", "router", "In")
+	}
+
+	log.Printf("GameServer: BuildPipeline: %s", strings.Join(append(names, "router"), " -> "))
+
+	return nil
+}
+
+// Validator drops packets whose tag or payload don't match the gnet
+// registry, and tells the client what was wrong
+type Validator struct {
+	flow.Component
+	In  <-chan *ClientPacket
+	Out chan<- *ClientPacket
+
+	world *GameServer
+}
+
+func NewValidator(w *GameServer) *Validator {
+	v := &Validator{world: w}
+	v.Component.Mode = flow.ComponentModeSync
+	return v
+}
+
+func (v *Validator) OnIn(p *ClientPacket) {
+	if err := gnet.Validate(p.Packet, gnet.CLIENT_TO_SERVER); err != nil {
+		log.Printf("Validator: OnIn: %s: %s", p, err)
+		v.world.Metrics.Drop("validate", p.Tag)
+		p.Reply(gnet.NewPacket("Rerror", err.Error()))
+		return
+	}
+
+	v.Out <- p
+}
+
+// AuthGate drops packets from sessions that haven't logged in. Sessions
+// only post packets after Login, so anything it stops is a bug somewhere.
+type AuthGate struct {
+	flow.Component
+	In  <-chan *ClientPacket
+	Out chan<- *ClientPacket
+
+	world *GameServer
+}
+
+func NewAuthGate(w *GameServer) *AuthGate {
+	a := &AuthGate{world: w}
+	a.Component.Mode = flow.ComponentModeSync
+	return a
+}
+
+func (a *AuthGate) OnIn(p *ClientPacket) {
+	if p.Client == nil || !p.Client.loggedIn {
+		log.Printf("AuthGate: OnIn: dropping %s from a session that isn't logged in", p.Packet)
+		a.world.Metrics.Drop("auth", p.Tag)
+		return
+	}
+
+	a.Out <- p
+}
+
+// LuaStage runs stages[name](cp) from the scripts for each packet, and
+// drops the packet if it returns false or fails. lua runs one thing at a
+// time, so this waits while the router is busy, and the other way round.
+type LuaStage struct {
+	flow.Component
+	In  <-chan *ClientPacket
+	Out chan<- *ClientPacket
+
+	world *GameServer
+	name  string // in the stages table
+}
+
+func NewLuaStage(w *GameServer, name string) *LuaStage {
+	l := &LuaStage{world: w, name: name}
+	l.Component.Mode = flow.ComponentModeSync
+	return l
+}
+
+func (l *LuaStage) OnIn(p *ClientPacket) {
+	pass, err := l.world.RunLuaStage(l.name, p)
+	if err != nil {
+		log.Printf("LuaStage: OnIn: %s: %s", p, err)
+	}
+
+	if !pass {
+		l.world.Metrics.Drop(LUA_STAGE_PREFIX+l.name, p.Tag)
+		return
+	}
+
+	// not holding luam, the router needs it to take this
+	l.Out <- p
+}
+
+// RunLuaStage calls stages[name](cp) and reports whether cp goes on
+func (gs *GameServer) RunLuaStage(name string, cp *ClientPacket) (bool, error) {
+	gs.luam.Lock()
+	defer gs.luam.Unlock()
+
+	fn := gs.luaTableFunc("stages", name)
+	if fn == nil {
+		return false, fmt.Errorf("no function stages.%s in the scripts", name)
+	}
+
+	res, err := fn.Call(cp)
+	if err != nil {
+		return false, fmt.Errorf("lua stage %s: %s", name, err)
+	}
+
+	// only an explicit false drops it
+	pass, ok := res.(bool)
+	return pass || !ok, nil
+}
+
+// PacketMetrics counts packets by tag: how many reached the router, how
+// many each stage dropped, and how many the router's handlers failed on.
+// Reported to the log every 'metricsinterval' seconds.
+type PacketMetrics struct {
+	Passed  map[string]uint64            // by tag
+	Dropped map[string]map[string]uint64 // by stage, then tag
+	Failed  map[string]uint64            // by tag
+	Since   time.Time                    // when counting started
+
+	m sync.Mutex
+}
+
+func NewPacketMetrics() *PacketMetrics {
+	pm := new(PacketMetrics)
+	pm.reset()
+	return pm
+}
+
+func (pm *PacketMetrics) reset() {
+	pm.Passed = make(map[string]uint64)
+	pm.Dropped = make(map[string]map[string]uint64)
+	pm.Failed = make(map[string]uint64)
+	pm.Since = time.Now()
+}
+
+// Pass counts a packet with tag that made it through the pipeline
+func (pm *PacketMetrics) Pass(tag string) {
+	pm.m.Lock()
+	pm.Passed[tag]++
+	pm.m.Unlock()
+}
+
+// Drop counts a packet with tag that stage dropped
+func (pm *PacketMetrics) Drop(stage, tag string) {
+	pm.m.Lock()
+	defer pm.m.Unlock()
+
+	if pm.Dropped[stage] == nil {
+		pm.Dropped[stage] = make(map[string]uint64)
+	}
+
+	pm.Dropped[stage][tag]++
+}
+
+// Fail counts a packet with tag whose handler returned an error
+func (pm *PacketMetrics) Fail(tag string) {
+	pm.m.Lock()
+	pm.Failed[tag]++
+	pm.m.Unlock()
+}
+
+// like "Taction 120 Tchat 3"
+func countsString(counts map[string]uint64) string {
+	tags := make([]string, 0, len(counts))
+	for tag := range counts {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	parts := make([]string, len(tags))
+	for i, tag := range tags {
+		parts[i] = fmt.Sprintf("%s %d", tag, counts[tag])
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func (pm *PacketMetrics) String() string {
+	pm.m.Lock()
+	defer pm.m.Unlock()
+
+	s := fmt.Sprintf("in the last %s: passed [%s] failed [%s]", time.Since(pm.Since)/time.Second*time.Second, countsString(pm.Passed), countsString(pm.Failed))
+
+	stages := make([]string, 0, len(pm.Dropped))
+	for stage := range pm.Dropped {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+
+	for _, stage := range stages {
+		s += fmt.Sprintf(" %s dropped [%s]", stage, countsString(pm.Dropped[stage]))
+	}
+
+	return s
+}
+
+// Report logs the counts and starts over
+func (pm *PacketMetrics) Report() {
+	log.Printf("PacketMetrics: %s", pm)
+
+	pm.m.Lock()
+	pm.reset()
+	pm.m.Unlock()
+}
+
+// ReportMetrics reports packet counts every interval until shutdown
+func (gs *GameServer) ReportMetrics(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			gs.Metrics.Report()
+		case <-gs.quit:
+			return
+		}
+	}
+}
+
+// MetricsStage counts what made it through the stages in front of it
+type MetricsStage struct {
+	flow.Component
+	In  <-chan *ClientPacket
+	Out chan<- *ClientPacket
+
+	world *GameServer
+}
+
+func NewMetricsStage(w *GameServer) *MetricsStage {
+	m := &MetricsStage{world: w}
+	m.Component.Mode = flow.ComponentModeSync
+	return m
+}
+
+func (m *MetricsStage) OnIn(p *ClientPacket) {
+	m.world.Metrics.Pass(p.Tag)
+	m.Out <- p
+}
@@ -0,0 +1,360 @@
+// RateLimiter: pipeline stage in front of the PacketRouter that drops packets
+// from clients sending faster than their token buckets allow, so one
+// client can't keep the router busy for everyone. Clients that keep at it
+// are kicked and banned for a while. ReceiveProc answers Tping and Tack
+// itself, so it charges those to buckets of its own with the same limits.
+package main
+
+import (
+	"fmt"
+	"github.com/mischief/goland/game/gnet"
+	"github.com/trustmaster/goflow"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// over the limit this many times in DEFAULT_RATE_WINDOW gets you kicked
+	DEFAULT_RATE_STRIKES = 50
+	DEFAULT_RATE_WINDOW  = 10 * time.Second
+
+	// and banned for this long, 0 to only kick
+	DEFAULT_RATE_BAN = 5 * time.Minute
+
+	// how often a throttled chatter is told to slow down
+	CHAT_WARN_INTERVAL = 2 * time.Second
+)
+
+var (
+	// used for anything missing from 'ratelimit' in the config
+	DefaultLimits = map[string]Limit{
+		"default": {Rate: 20, Burst: 40},
+		"Taction": {Rate: 40, Burst: 80},
+		"Tchat":   {Rate: 1, Burst: 5},
+		"Tcamera": {Rate: 30, Burst: 60},
+		"Tping":   {Rate: 2, Burst: 10},
+		"Tack":    {Rate: 60, Burst: 120},
+	}
+
+	// always let through, or sessions couldn't come and go. only
+	// ReceiveProc makes these, clients can't send them.
+	unlimited = map[string]bool{
+		"Tconnect":    true,
+		"Tdisconnect": true,
+	}
+)
+
+// Limit is how many packets per second a client may send, and how many
+// it may send at once after being quiet
+type Limit struct {
+	Rate  float64
+	Burst float64
+}
+
+// TokenBucket holds up to Burst tokens, refilled at Rate a second.
+// Each packet takes one.
+type TokenBucket struct {
+	Limit
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(l Limit) *TokenBucket {
+	return &TokenBucket{Limit: l, tokens: l.Burst, last: time.Now()}
+}
+
+// Take takes a token if there is one
+func (b *TokenBucket) Take(now time.Time) bool {
+	// callers may have read the clock before the bucket was made
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.Rate
+		if b.tokens > b.Burst {
+			b.tokens = b.Burst
+		}
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// RateLimits is how fast clients may send, and what happens to those
+// that send faster
+type RateLimits struct {
+	Limits  map[string]Limit // by tag, "default" for the rest
+	Strikes int              // drops in Window before a kick
+	Window  time.Duration    // how long strikes count for
+	BanFor  time.Duration    // how long a kick for flooding bans the account
+}
+
+func LoadRateLimits(w *GameServer) *RateLimits {
+	rl := new(RateLimits)
+
+	rl.Limits = make(map[string]Limit)
+	for tag, l := range DefaultLimits {
+		rl.Limits[tag] = l
+	}
+
+	// ratelimit = { Tchat = { rate = 1, burst = 5 }, ... }
+	if conf, err := w.config.Get("ratelimit", reflect.Map); err == nil {
+		for tag, v := range conf.(map[string]interface{}) {
+			lt, ok := v.(map[string]interface{})
+			if !ok {
+				log.Printf("RateLimits: ratelimit.%s is not a table", tag)
+				continue
+			}
+
+			l := rl.Limits[tag]
+			if rate, ok := lt["rate"].(float64); ok {
+				l.Rate = rate
+			}
+			if burst, ok := lt["burst"].(float64); ok {
+				l.Burst = burst
+			}
+
+			// a bucket that never fills, or never holds a whole token,
+			// drops everything
+			if l.Rate <= 0 || l.Burst < 1 {
+				def, ok := DefaultLimits[tag]
+				if !ok {
+					def = DefaultLimits["default"]
+				}
+
+				log.Printf("RateLimits: ratelimit.%s of %g a second, %g at once makes no sense. defaulting to %g, %g", tag, l.Rate, l.Burst, def.Rate, def.Burst)
+				l = def
+			}
+
+			rl.Limits[tag] = l
+		}
+	}
+
+	rl.Strikes = w.configInt("ratestrikes", DEFAULT_RATE_STRIKES)
+	rl.Window = w.configDuration("ratewindow", DEFAULT_RATE_WINDOW)
+	rl.BanFor = w.configDuration("rateban", DEFAULT_RATE_BAN)
+
+	return rl
+}
+
+// what the limits know about one session
+type sessionLimits struct {
+	buckets map[string]*TokenBucket // by tag
+
+	strikes     int       // packets dropped since windowStart
+	windowStart time.Time // when we started counting them
+	warned      time.Time // last told to slow down
+	kicked      bool      // drop everything from now on
+}
+
+func newSessionLimits(now time.Time) *sessionLimits {
+	return &sessionLimits{buckets: make(map[string]*TokenBucket), windowStart: now}
+}
+
+// Take takes a token for a packet with tag. It reports whether the packet
+// may pass, and whether the session was over its limits often enough that
+// it's now kicked.
+func (sl *sessionLimits) Take(rl *RateLimits, tag string, now time.Time) (ok, kick bool) {
+	if sl.kicked {
+		return false, false
+	}
+
+	b, ok := sl.buckets[tag]
+	if !ok {
+		l, ok := rl.Limits[tag]
+		if !ok {
+			l = rl.Limits["default"]
+		}
+
+		b = NewTokenBucket(l)
+		sl.buckets[tag] = b
+	}
+
+	if b.Take(now) {
+		return true, false
+	}
+
+	if now.Sub(sl.windowStart) > rl.Window {
+		sl.strikes = 0
+		sl.windowStart = now
+	}
+
+	sl.strikes++
+
+	if sl.strikes >= rl.Strikes {
+		sl.kicked = true
+		return false, true
+	}
+
+	return false, false
+}
+
+type RateLimiter struct {
+	flow.Component
+	In  <-chan *ClientPacket // from the sessions
+	Out chan<- *ClientPacket // to the router
+
+	*RateLimits
+
+	sessions map[*WorldSession]*sessionLimits
+
+	world *GameServer
+}
+
+func NewRateLimiter(w *GameServer) *RateLimiter {
+	rl := new(RateLimiter)
+
+	// sessions is only touched from OnIn
+	rl.Component.Mode = flow.ComponentModeSync
+
+	rl.world = w
+	rl.sessions = make(map[*WorldSession]*sessionLimits)
+	rl.RateLimits = w.RateLimits
+
+	return rl
+}
+
+func (rl *RateLimiter) OnIn(p *ClientPacket) {
+	if unlimited[p.Tag] {
+		if p.Tag == "Tdisconnect" {
+			delete(rl.sessions, p.Client)
+		}
+
+		rl.Out <- p
+		return
+	}
+
+	if rl.Allow(p) {
+		rl.Out <- p
+	} else {
+		rl.world.Metrics.Drop("limiter", p.Tag)
+	}
+}
+
+// Allow takes a token for p from its session's bucket, and deals with
+// sessions that are over their limit
+func (rl *RateLimiter) Allow(p *ClientPacket) bool {
+	now := time.Now()
+
+	sl, ok := rl.sessions[p.Client]
+	if !ok {
+		sl = newSessionLimits(now)
+		rl.sessions[p.Client] = sl
+	}
+
+	ok, kick := sl.Take(rl.RateLimits, p.Tag, now)
+	if ok {
+		return true
+	}
+
+	if kick {
+		rl.world.Punish(p.Client)
+		return false
+	}
+
+	if sl.kicked {
+		return false
+	}
+
+	if p.Tag == "Tchat" && now.Sub(sl.warned) > CHAT_WARN_INTERVAL {
+		sl.warned = now
+		p.Reply(gnet.NewPacket("Rchat", "You're chatting too fast. Slow down!"))
+	}
+
+	return false
+}
+
+// Allow charges a packet with tag that ReceiveProc answers itself, and so
+// never reaches the RateLimiter, to sl. Over the limit it's dropped without
+// a word, and a client that keeps at it is kicked like any other flooder.
+// Only called from ReceiveProc.
+func (ws *WorldSession) Allow(sl *sessionLimits, tag string) bool {
+	ok, kick := sl.Take(ws.World.RateLimits, tag, time.Now())
+	if ok {
+		return true
+	}
+
+	ws.World.Metrics.Drop("receive", tag)
+
+	if kick {
+		ws.World.Punish(ws)
+	}
+
+	return false
+}
+
+// Punish kicks ws for flooding, and bans its account if we do that
+func (gs *GameServer) Punish(ws *WorldSession) {
+	banfor := gs.RateLimits.BanFor
+
+	log.Printf("GameServer: Punish: %s flooding, kicking and banning for %s", ws, banfor)
+
+	if banfor > 0 {
+		gs.Bans.Ban(ws.Username, hostOf(ws.Con.RemoteAddr()), banfor)
+		ws.Kick(fmt.Sprintf("Kicked for flooding. You're banned for %s.", banfor))
+	} else {
+		ws.Kick("Kicked for flooding.")
+	}
+}
+
+// BanList is who may not log in, and until when. Both the account and the
+// address it was using are banned, so a new account doesn't get around it.
+type BanList struct {
+	until map[string]time.Time // by "user " and lowercased name, or "addr " and host
+	m     sync.Mutex
+}
+
+func NewBanList() *BanList {
+	return &BanList{until: make(map[string]time.Time)}
+}
+
+func banKeys(name, addr string) []string {
+	var keys []string
+	if name != "" {
+		keys = append(keys, "user "+strings.ToLower(name))
+	}
+	if addr != "" {
+		keys = append(keys, "addr "+addr)
+	}
+
+	return keys
+}
+
+// Ban keeps name, and anyone from addr, out for d. Either may be empty.
+func (bl *BanList) Ban(name, addr string, d time.Duration) {
+	bl.m.Lock()
+	defer bl.m.Unlock()
+
+	for _, key := range banKeys(name, addr) {
+		bl.until[key] = time.Now().Add(d)
+	}
+}
+
+// Banned reports whether name or addr is banned, and for how much longer.
+// Either may be empty.
+func (bl *BanList) Banned(name, addr string) (time.Duration, bool) {
+	bl.m.Lock()
+	defer bl.m.Unlock()
+
+	var left time.Duration
+	for _, key := range banKeys(name, addr) {
+		until, ok := bl.until[key]
+		if !ok {
+			continue
+		}
+
+		l := until.Sub(time.Now())
+		if l <= 0 {
+			delete(bl.until, key)
+		} else if l > left {
+			left = l
+		}
+	}
+
+	return left, left > 0
+}
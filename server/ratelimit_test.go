@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	type take struct {
+		after time.Duration // since the bucket was made
+		want  bool
+	}
+
+	tests := []struct {
+		name  string
+		limit Limit
+		takes []take
+	}{
+		{"burst then empty", Limit{Rate: 1, Burst: 3}, []take{
+			{0, true}, {0, true}, {0, true}, {0, false},
+		}},
+		{"refills at rate", Limit{Rate: 2, Burst: 1}, []take{
+			{0, true},
+			{100 * time.Millisecond, false},
+			{500 * time.Millisecond, true},
+			{600 * time.Millisecond, false},
+			{time.Second, true},
+		}},
+		{"never more than burst", Limit{Rate: 10, Burst: 2}, []take{
+			{time.Hour, true}, {time.Hour, true}, {time.Hour, false},
+		}},
+		{"fractional tokens don't count", Limit{Rate: 1, Burst: 1}, []take{
+			{0, true},
+			{900 * time.Millisecond, false},
+			{1900 * time.Millisecond, true},
+		}},
+		{"clock read before the bucket was made", Limit{Rate: 1, Burst: 1}, []take{
+			{-time.Millisecond, true},
+			{-time.Millisecond, false},
+		}},
+		{"steady at rate", Limit{Rate: 4, Burst: 1}, []take{
+			{0, true},
+			{250 * time.Millisecond, true},
+			{500 * time.Millisecond, true},
+			{750 * time.Millisecond, true},
+		}},
+	}
+
+	for _, tt := range tests {
+		b := NewTokenBucket(tt.limit)
+		start := b.last
+
+		for i, tk := range tt.takes {
+			if got := b.Take(start.Add(tk.after)); got != tk.want {
+				t.Errorf("%s: take %d at %s: %t, want %t", tt.name, i, tk.after, got, tk.want)
+			}
+		}
+	}
+}
+
+func TestSessionLimitsKick(t *testing.T) {
+	rl := &RateLimits{
+		Limits:  map[string]Limit{"default": {Rate: 1, Burst: 1}},
+		Strikes: 3,
+		Window:  time.Second,
+	}
+
+	now := time.Now()
+	sl := newSessionLimits(now)
+
+	if ok, _ := sl.Take(rl, "Tping", now); !ok {
+		t.Fatal("first packet dropped")
+	}
+
+	// the strikes run out within the window
+	for i := 1; i <= rl.Strikes; i++ {
+		ok, kick := sl.Take(rl, "Tping", now)
+		if ok {
+			t.Fatalf("packet %d over the limit let through", i)
+		}
+
+		if kick != (i == rl.Strikes) {
+			t.Fatalf("strike %d: kick %t", i, kick)
+		}
+	}
+
+	// and once kicked, nothing more gets through or kicks again
+	if ok, kick := sl.Take(rl, "Tping", now.Add(time.Hour)); ok || kick {
+		t.Fatalf("kicked session: ok %t kick %t", ok, kick)
+	}
+}
@@ -0,0 +1,82 @@
+// Session resume: a dropped client gets a grace period to reconnect
+// with its resume token and take back the same player object.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/mischief/goland/game/gnet"
+	"log"
+	"time"
+)
+
+const (
+	DEFAULT_RESUME_GRACE = 30 * time.Second
+)
+
+// make an unguessable resume token
+func NewResumeToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// Park keeps a disconnected session's player in the world for the grace
+// period. When it runs out a second Tdisconnect removes the player for good.
+// Only called from the router goroutine.
+func (gs *GameServer) Park(ws *WorldSession) {
+	log.Printf("GameServer: Park: parking %s for %s", ws.Player, gs.ResumeGrace)
+
+	ws.parked = true
+	ws.parkTimer = time.AfterFunc(gs.ResumeGrace, func() {
+		// after shutdown End saves the player instead
+		gs.Post(&ClientPacket{ws, gnet.NewPacket("Tdisconnect", nil)})
+	})
+}
+
+// Resume moves the player held under token to ws. The old session may be
+// parked, or may be half-open and not know it's dead yet, in which case we
+// hang it up. Only called from the router goroutine.
+func (gs *GameServer) Resume(ws *WorldSession, token string) error {
+	old, ok := gs.Resumable[token]
+	if !ok || old.Player == nil {
+		return fmt.Errorf("no session to resume")
+	}
+
+	if old.Username != ws.Username {
+		return fmt.Errorf("resume token belongs to another user")
+	}
+
+	gs.TakeOver(ws, old, "")
+
+	return nil
+}
+
+// TakeOver moves old's player to ws. If old is still connected it is told
+// why and hung up, quietly if why is empty. Only called from the router.
+func (gs *GameServer) TakeOver(ws, old *WorldSession, why string) {
+	delete(gs.Resumable, old.ResumeToken)
+
+	if old.parkTimer != nil {
+		old.parkTimer.Stop()
+	}
+
+	// if old's expiry Tdisconnect is already queued, it finds no player
+	ws.Player = old.Player
+	ws.savedAt = old.savedAt
+	old.Player = nil
+
+	if !old.parked {
+		if why != "" {
+			old.Kick(why)
+		} else {
+			old.queue.Close(nil)
+		}
+	}
+
+	log.Printf("GameServer: TakeOver: %s took over %s", ws.Con.RemoteAddr(), ws.Player)
+}
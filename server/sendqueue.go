@@ -0,0 +1,206 @@
+// Send queues: every session gets a bounded queue of outgoing packets
+// drained by its own writer, so one slow client can't hold up the router
+// and everyone else with it.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mischief/goland/game"
+	"github.com/mischief/goland/game/gnet"
+	"sync"
+	"time"
+)
+
+// what to do when a client's send queue is full
+type OverflowPolicy int
+
+const (
+	OVERFLOW_DROP       OverflowPolicy = iota // throw away the oldest snapshot
+	OVERFLOW_COALESCE                         // replace a queued snapshot with the newer one
+	OVERFLOW_DISCONNECT                       // hang up on the client
+)
+
+const (
+	DEFAULT_SEND_QUEUE  = 256
+	DEFAULT_SEND_POLICY = OVERFLOW_COALESCE
+
+	// a client that won't take a packet for this long is gone
+	WRITE_TIMEOUT = 10 * time.Second
+)
+
+var (
+	OverflowPolicies = map[string]OverflowPolicy{
+		"drop":       OVERFLOW_DROP,
+		"coalesce":   OVERFLOW_COALESCE,
+		"disconnect": OVERFLOW_DISCONNECT,
+	}
+
+	ErrQueueFull   = errors.New("send queue full")
+	ErrQueueClosed = errors.New("send queue closed")
+)
+
+func (p OverflowPolicy) String() string {
+	for name, pol := range OverflowPolicies {
+		if pol == p {
+			return name
+		}
+	}
+
+	return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+}
+
+// counters for a SendQueue
+type SendQueueStats struct {
+	Depth     int    // packets waiting right now
+	HighWater int    // most packets ever waiting
+	Sent      uint64 // packets handed to the writer
+	Dropped   uint64 // snapshots thrown away to make room
+	Coalesced uint64 // snapshots replaced by a newer one
+}
+
+func (s SendQueueStats) String() string {
+	return fmt.Sprintf("depth %d high %d sent %d dropped %d coalesced %d",
+		s.Depth, s.HighWater, s.Sent, s.Dropped, s.Coalesced)
+}
+
+// SendQueue is a bounded packet queue with one reader and many writers
+type SendQueue struct {
+	Max    int
+	Policy OverflowPolicy
+
+	pks    []*gnet.Packet
+	closed bool
+	stats  SendQueueStats
+
+	m sync.Mutex
+	c *sync.Cond
+}
+
+func NewSendQueue(max int, policy OverflowPolicy) *SendQueue {
+	q := &SendQueue{Max: max, Policy: policy}
+	q.c = sync.NewCond(&q.m)
+	return q
+}
+
+// stale packets are made useless by a newer one. a snapshot is diffed
+// against a state the client acked, so a newer one has everything an
+// older one has, and any of them can be skipped.
+func stale(pk *gnet.Packet) bool {
+	return pk.Tag == "Rsnapshot"
+}
+
+// index of the oldest queued stale packet, or -1
+func (q *SendQueue) oldestStale() int {
+	for i, qp := range q.pks {
+		if stale(qp) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Push queues pk, making room according to Policy if the queue is full.
+// ErrQueueFull means the client is too far behind to keep.
+func (q *SendQueue) Push(pk *gnet.Packet) error {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	// a client only ever needs the newest snapshot
+	if q.Policy == OVERFLOW_COALESCE && stale(pk) {
+		if i := q.oldestStale(); i >= 0 {
+			q.pks = append(q.pks[:i], q.pks[i+1:]...)
+			q.stats.Coalesced++
+		}
+	}
+
+	if len(q.pks) >= q.Max {
+		if q.Policy == OVERFLOW_DISCONNECT {
+			return ErrQueueFull
+		}
+
+		// nothing we may throw away, so the client can't catch up
+		i := q.oldestStale()
+		if i < 0 {
+			return ErrQueueFull
+		}
+
+		q.pks = append(q.pks[:i], q.pks[i+1:]...)
+		q.stats.Dropped++
+	}
+
+	q.pks = append(q.pks, pk)
+
+	if len(q.pks) > q.stats.HighWater {
+		q.stats.HighWater = len(q.pks)
+	}
+
+	q.c.Signal()
+	return nil
+}
+
+// Pop waits for the next packet. It returns false once the queue is closed
+// and empty.
+func (q *SendQueue) Pop() (*gnet.Packet, bool) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	for len(q.pks) == 0 && !q.closed {
+		q.c.Wait()
+	}
+
+	if len(q.pks) == 0 {
+		return nil, false
+	}
+
+	pk := q.pks[0]
+	q.pks[0] = nil
+	q.pks = q.pks[1:]
+	q.stats.Sent++
+
+	return pk, true
+}
+
+// Close throws away anything still queued and stops accepting packets.
+// If last isn't nil it is the one packet Pop still returns.
+func (q *SendQueue) Close(last *gnet.Packet) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	if q.closed {
+		return
+	}
+
+	q.pks = nil
+	if last != nil {
+		q.pks = append(q.pks, last)
+	}
+
+	q.closed = true
+	q.c.Broadcast()
+}
+
+func (q *SendQueue) Stats() SendQueueStats {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	s := q.stats
+	s.Depth = len(q.pks)
+	return s
+}
+
+// copy object payloads, since the writer encodes them later
+// while the router keeps changing the originals. updates are
+// built from copies already.
+func snapshot(pk *gnet.Packet) *gnet.Packet {
+	if o, ok := pk.Data.(*game.GameObject); ok {
+		return gnet.NewPacket(pk.Tag, o.Copy())
+	}
+
+	return pk
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"github.com/mischief/goland/game/gnet"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// packets are told apart by tag and number, like "Rsnapshot 3"
+func testPacket(tag string, n int) *gnet.Packet {
+	return gnet.NewPacket(tag, strconv.Itoa(n))
+}
+
+// everything the writer would get, without waiting for more
+func drain(q *SendQueue) []*gnet.Packet {
+	var pks []*gnet.Packet
+	for n := q.Stats().Depth; n > 0; n-- {
+		pk, _ := q.Pop()
+		pks = append(pks, pk)
+	}
+
+	return pks
+}
+
+func TestSendQueueOverflow(t *testing.T) {
+	chat := func(n int) *gnet.Packet { return testPacket("Rchat", n) }
+	snap := func(n int) *gnet.Packet { return testPacket("Rsnapshot", n) }
+
+	tests := []struct {
+		name    string
+		max     int
+		policy  OverflowPolicy
+		push    []*gnet.Packet
+		want    []*gnet.Packet // what the writer gets
+		wantErr error          // from the last push
+		stats   SendQueueStats // dropped and coalesced
+	}{
+		{"room left", 4, OVERFLOW_DROP,
+			[]*gnet.Packet{chat(1), snap(1), chat(2)},
+			[]*gnet.Packet{chat(1), snap(1), chat(2)}, nil, SendQueueStats{}},
+
+		{"drop oldest snapshot", 3, OVERFLOW_DROP,
+			[]*gnet.Packet{snap(1), chat(1), snap(2), snap(3)},
+			[]*gnet.Packet{chat(1), snap(2), snap(3)}, nil, SendQueueStats{Dropped: 1}},
+		{"drop keeps snapshots while there's room", 3, OVERFLOW_DROP,
+			[]*gnet.Packet{snap(1), snap(2)},
+			[]*gnet.Packet{snap(1), snap(2)}, nil, SendQueueStats{}},
+		{"drop with nothing to drop", 2, OVERFLOW_DROP,
+			[]*gnet.Packet{chat(1), chat(2), chat(3)},
+			[]*gnet.Packet{chat(1), chat(2)}, ErrQueueFull, SendQueueStats{}},
+
+		{"coalesce snapshots", 4, OVERFLOW_COALESCE,
+			[]*gnet.Packet{snap(1), chat(1), snap(2), snap(3)},
+			[]*gnet.Packet{chat(1), snap(3)}, nil, SendQueueStats{Coalesced: 2}},
+		{"coalesce then full", 2, OVERFLOW_COALESCE,
+			[]*gnet.Packet{chat(1), chat(2), snap(1)},
+			[]*gnet.Packet{chat(1), chat(2)}, ErrQueueFull, SendQueueStats{}},
+		{"coalesce leaves the rest alone", 2, OVERFLOW_COALESCE,
+			[]*gnet.Packet{chat(1), chat(2), chat(3)},
+			[]*gnet.Packet{chat(1), chat(2)}, ErrQueueFull, SendQueueStats{}},
+
+		{"disconnect", 2, OVERFLOW_DISCONNECT,
+			[]*gnet.Packet{snap(1), snap(2), snap(3)},
+			[]*gnet.Packet{snap(1), snap(2)}, ErrQueueFull, SendQueueStats{}},
+	}
+
+	for _, tt := range tests {
+		q := NewSendQueue(tt.max, tt.policy)
+
+		var err error
+		for _, pk := range tt.push {
+			err = q.Push(pk)
+		}
+
+		if err != tt.wantErr {
+			t.Errorf("%s: last Push: %v, want %v", tt.name, err, tt.wantErr)
+		}
+
+		st := q.Stats()
+		if st.Dropped != tt.stats.Dropped || st.Coalesced != tt.stats.Coalesced {
+			t.Errorf("%s: stats %s, want dropped %d coalesced %d", tt.name, st, tt.stats.Dropped, tt.stats.Coalesced)
+		}
+
+		if st.Depth > tt.max || st.HighWater > tt.max {
+			t.Errorf("%s: stats %s, over max %d", tt.name, st, tt.max)
+		}
+
+		if got := drain(q); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: sent %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSendQueueClose(t *testing.T) {
+	q := NewSendQueue(4, OVERFLOW_DROP)
+	q.Push(testPacket("Rchat", 1))
+
+	bye := testPacket("Rbye", 0)
+	q.Close(bye)
+
+	if err := q.Push(testPacket("Rchat", 2)); err != ErrQueueClosed {
+		t.Errorf("Push after Close: %v, want %v", err, ErrQueueClosed)
+	}
+
+	// only the last word is left
+	if pk, ok := q.Pop(); !ok || pk != bye {
+		t.Errorf("Pop after Close: %v %t, want %v", pk, ok, bye)
+	}
+
+	if pk, ok := q.Pop(); ok {
+		t.Errorf("Pop after the last packet: %v", pk)
+	}
+}
@@ -0,0 +1,146 @@
+// Shutdown: on SIGINT or SIGTERM the server stops taking connections,
+// counts down so players know what's coming, sends everyone away, lets
+// the router finish what's queued and saves.
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	DEFAULT_SHUTDOWN_DELAY = 10 * time.Second
+
+	// how long kicked sessions get to leave before we stop the router anyway
+	DRAIN_TIMEOUT = 5 * time.Second
+)
+
+// Post hands cp to the router, or returns false if the router has stopped.
+// Everything but the router itself sends packets in through here.
+func (gs *GameServer) Post(cp *ClientPacket) bool {
+	gs.inm.RLock()
+	defer gs.inm.RUnlock()
+
+	if gs.inClosed {
+		return false
+	}
+
+	gs.PacketChan <- cp
+	return true
+}
+
+// Closing reports whether the server is shutting down
+func (gs *GameServer) Closing() bool {
+	select {
+	case <-gs.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// HandleSignals shuts down on SIGINT or SIGTERM. A second one skips the
+// rest of the countdown, a third gives up on shutting down nicely.
+func (gs *GameServer) HandleSignals() {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+
+	sig := <-sigc
+	log.Printf("GameServer: HandleSignals: got %s, shutting down", sig)
+
+	go func() {
+		sig := <-sigc
+		log.Printf("GameServer: HandleSignals: got %s, hurrying up", sig)
+		close(gs.hurry)
+
+		sig = <-sigc
+		log.Printf("GameServer: HandleSignals: got %s, exiting now", sig)
+		os.Exit(1)
+	}()
+
+	gs.Shutdown()
+}
+
+// Shutdown takes the server down. Run returns once it's done.
+func (gs *GameServer) Shutdown() {
+	close(gs.quit)
+
+	// no new players
+	gs.Listener.Close()
+	for _, l := range gs.Listeners {
+		l.Close()
+	}
+
+	gs.Countdown()
+	gs.Drain()
+
+	close(gs.stopped)
+}
+
+// Countdown warns everyone every ten seconds, then every second at the end
+func (gs *GameServer) Countdown() {
+	total := int(gs.ShutdownDelay / time.Second)
+
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	for secs := total; secs > 0; secs-- {
+		if secs == total || secs%10 == 0 || secs <= 5 {
+			gs.SendPkStrAll("Rchat", fmt.Sprintf("The server is shutting down in %d seconds!", secs))
+		}
+
+		select {
+		case <-t.C:
+		case <-gs.hurry:
+			return
+		}
+	}
+}
+
+// Drain sends everyone away and stops the router once it has finished
+// with what they left behind
+func (gs *GameServer) Drain() {
+	// their Tdisconnects take their players out of the world and save them
+	for _, ws := range gs.AttachedSessions() {
+		ws.Kick("The server is shutting down.")
+	}
+
+	deadline := time.Now().Add(DRAIN_TIMEOUT)
+	for len(gs.AttachedSessions()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if n := len(gs.AttachedSessions()); n > 0 {
+		log.Printf("GameServer: Drain: %d sessions still around, stopping anyway", n)
+	}
+
+	// the router finishes once both its inputs are closed.
+	// Ticker closes the Tick one on its way out.
+	close(gs.stopTick)
+
+	gs.inm.Lock()
+	gs.inClosed = true
+	close(gs.PacketChan)
+	gs.inm.Unlock()
+
+	<-gs.Wait()
+
+	log.Printf("GameServer: Drain: router stopped")
+}
+
+// sessions that get world traffic
+func (gs *GameServer) AttachedSessions() []*WorldSession {
+	gs.DefaultSubject.Lock()
+	defer gs.DefaultSubject.Unlock()
+
+	var sessions []*WorldSession
+	for s := gs.DefaultSubject.Observers.Front(); s != nil; s = s.Next() {
+		sessions = append(sessions, s.Value.(*WorldSession))
+	}
+
+	return sessions
+}
@@ -0,0 +1,220 @@
+// Snapshots: each tick every session gets the deltas between the last
+// world state its client acknowledged and the current one.
+//
+// a client only sees objects near its player, its area of interest.
+// things coming into the area show up as new objects in a snapshot
+// and things leaving it as removed ones.
+package main
+
+import (
+	"github.com/mischief/goland/game"
+	"github.com/mischief/goland/game/gnet"
+	"image"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// unacked states we keep per client. a client further behind than
+	// this gets diffs against its last ack until it catches up.
+	MAX_UNACKED = 64
+
+	// how far from its player a client sees, in cells either way.
+	// enough for a big terminal.
+	DEFAULT_AOI_RADIUS = 48
+)
+
+// ClientView tracks which world states a client has
+type ClientView struct {
+	AckSeq uint64          // last state the client acknowledged
+	acked  game.WorldState // and what it was
+
+	sent  map[uint64]game.WorldState // states sent but not acked yet
+	order []uint64                   // seqs in sent, oldest first
+
+	inputAck uint32 // InputAck of the last snapshot
+	seq      uint64 // Seq of the last snapshot, only ever goes up
+
+	m sync.Mutex
+}
+
+func NewClientView() *ClientView {
+	return &ClientView{
+		acked: game.WorldState{},
+		sent:  make(map[uint64]game.WorldState),
+	}
+}
+
+// Snapshot returns what the client needs to get to state cur, as of
+// server time at, and to learn input was run, or nil if it knows already
+func (cv *ClientView) Snapshot(cur game.WorldState, input uint32, at time.Duration) *game.Snapshot {
+	cv.m.Lock()
+	defer cv.m.Unlock()
+
+	// a rejected move changes nothing, but the client still has to hear
+	// about it to stop predicting it
+	if len(cv.acked.Diff(cur)) == 0 && input == cv.inputAck {
+		return nil
+	}
+
+	return cv.snapshot(cur, input, at)
+}
+
+// JoinSnapshot is like Snapshot, but always returns one, even if the
+// client has seen all there is to see
+func (cv *ClientView) JoinSnapshot(cur game.WorldState, input uint32, at time.Duration) *game.Snapshot {
+	cv.m.Lock()
+	defer cv.m.Unlock()
+
+	return cv.snapshot(cur, input, at)
+}
+
+// record cur as sent under a new seq. call with cv.m held.
+func (cv *ClientView) snapshot(cur game.WorldState, input uint32, at time.Duration) *game.Snapshot {
+	deltas := cv.acked.Diff(cur)
+
+	cv.inputAck = input
+
+	// clients ignore seqs they've had, so never reuse one
+	cv.seq++
+	seq := cv.seq
+
+	cv.sent[seq] = cur
+	cv.order = append(cv.order, seq)
+
+	if len(cv.order) > MAX_UNACKED {
+		delete(cv.sent, cv.order[0])
+		cv.order = cv.order[1:]
+	}
+
+	return &game.Snapshot{Seq: seq, Base: cv.AckSeq, Deltas: deltas, InputAck: input, Time: at}
+}
+
+// Ack records that the client has the state at seq
+func (cv *ClientView) Ack(seq uint64) {
+	cv.m.Lock()
+	defer cv.m.Unlock()
+
+	st, ok := cv.sent[seq]
+	if !ok {
+		// too old, or one we never sent
+		return
+	}
+
+	cv.AckSeq = seq
+	cv.acked = st
+
+	for len(cv.order) > 0 && cv.order[0] <= seq {
+		delete(cv.sent, cv.order[0])
+		cv.order = cv.order[1:]
+	}
+}
+
+// answer a Tack from the session's reader, like pings
+func (ws *WorldSession) HandleAck(pk *gnet.Packet) error {
+	return gnet.Call(pk, gnet.CLIENT_TO_SERVER, func(pk *gnet.Packet) error {
+		ws.View.Ack(pk.Data.(uint64))
+		return nil
+	})
+}
+
+// bring State up to date with Objects. only objects that changed
+// since the last tick get a new ObjectState, the rest are shared with the old one.
+func (gs *GameServer) UpdateState() {
+	cur := make(game.WorldState, len(gs.State))
+
+	for o := range gs.Objects.Chan() {
+		id := o.GetID()
+
+		if st, ok := gs.State[id]; ok && !o.IsDirty() {
+			cur[id] = st
+			continue
+		}
+
+		o.SetDirty(false)
+
+		if gob, ok := o.(*game.GameObject); ok {
+			cur[id] = game.NewObjectState(gob)
+		} else {
+			log.Printf("GameServer: UpdateState: can't send %T %s", o, o)
+		}
+	}
+
+	gs.State = cur
+}
+
+// the part of State ws's client gets to see
+func (gs *GameServer) ViewOf(ws *WorldSession) game.WorldState {
+	if gs.AOIRadius <= 0 {
+		return gs.State
+	}
+
+	view := game.WorldState{}
+
+	c, ok := gs.ViewCenter(ws)
+	if !ok {
+		return view
+	}
+
+	r := image.Rect(c.X-gs.AOIRadius, c.Y-gs.AOIRadius, c.X+gs.AOIRadius+1, c.Y+gs.AOIRadius+1)
+
+	for _, o := range gs.Objects.ObjectsInRect(r) {
+		if st, ok := gs.State[o.GetID()]; ok {
+			view[o.GetID()] = st
+		}
+	}
+
+	// spectators see every player, so they can follow any of them
+	if ws.Spectator {
+		for _, pws := range gs.Online {
+			if pws.Player == nil {
+				continue
+			}
+
+			if st, ok := gs.State[pws.Player.GetID()]; ok {
+				view[pws.Player.GetID()] = st
+			}
+		}
+	}
+
+	return view
+}
+
+// Join sends ws everything it needs to enter the world as one Rjoin.
+// the snapshot in it is the client's first state, acked like any other,
+// and regular snapshots only start after it. Only called from the router.
+func (gs *GameServer) Join(ws *WorldSession) {
+	// include whatever changed since the last tick, like our new player
+	gs.UpdateState()
+
+	join := &game.Join{Map: gs.Map}
+
+	if ws.Player != nil {
+		join.PlayerID = ws.Player.GetID()
+	}
+
+	join.Snapshot = ws.View.JoinSnapshot(gs.ViewOf(ws), ws.LastInput, gs.Clock())
+
+	ws.joined = true
+	ws.SendPacket(gnet.NewPacket("Rjoin", join))
+}
+
+// send every session the changes since its last ack
+func (gs *GameServer) SendSnapshots() {
+	gs.UpdateState()
+
+	gs.DefaultSubject.Lock()
+	defer gs.DefaultSubject.Unlock()
+
+	for s := gs.DefaultSubject.Observers.Front(); s != nil; s = s.Next() {
+		ws := s.Value.(*WorldSession)
+		if !ws.joined {
+			continue
+		}
+
+		if snap := ws.View.Snapshot(gs.ViewOf(ws), ws.LastInput, gs.Clock()); snap != nil {
+			ws.enqueue(gnet.NewPacket("Rsnapshot", snap))
+		}
+	}
+}
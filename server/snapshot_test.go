@@ -0,0 +1,162 @@
+package main
+
+import (
+	"github.com/mischief/goland/game"
+	"image"
+	"testing"
+)
+
+func worldWith(ids ...int) game.WorldState {
+	ws := game.WorldState{}
+	for _, id := range ids {
+		ws[id] = &game.ObjectState{Name: "thing", Pos: image.Pt(id, id), Tags: map[string]bool{"visible": true}}
+	}
+
+	return ws
+}
+
+// what the client does with a snapshot: apply it to the state it was
+// diffed against, if it has that one
+type fakeClient struct {
+	states map[uint64]game.WorldState
+	seq    uint64
+}
+
+func (fc *fakeClient) apply(t *testing.T, snap *game.Snapshot) {
+	if snap.Seq <= fc.seq {
+		t.Fatalf("snapshot %d after %d", snap.Seq, fc.seq)
+	}
+
+	base, ok := fc.states[snap.Base]
+	if !ok {
+		t.Fatalf("snapshot %d against state %d the client doesn't have", snap.Seq, snap.Base)
+	}
+
+	fc.states[snap.Seq] = base.Apply(snap.Deltas)
+	fc.seq = snap.Seq
+}
+
+func TestClientViewSequence(t *testing.T) {
+	type step struct {
+		world   []int // ids in the world this tick
+		input   uint32
+		join    bool // JoinSnapshot instead of Snapshot
+		ack     bool // client acks what it got
+		want    bool // a snapshot is sent
+		wantSeq uint64
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"nothing to send", []step{
+			{world: nil, want: false},
+			{world: nil, want: false},
+		}},
+		{"join always sends", []step{
+			{world: nil, join: true, want: true, wantSeq: 1},
+			{world: nil, want: false},
+		}},
+		{"acked", []step{
+			{world: []int{1}, ack: true, want: true, wantSeq: 1},
+			{world: []int{1}, want: false},
+			{world: []int{1, 2}, ack: true, want: true, wantSeq: 2},
+		}},
+		{"unacked resends", []step{
+			{world: []int{1}, want: true, wantSeq: 1},
+			{world: []int{1}, want: true, wantSeq: 2},
+			{world: []int{1}, ack: true, want: true, wantSeq: 3},
+			{world: []int{1}, want: false},
+		}},
+		{"input ack alone", []step{
+			{world: []int{1}, ack: true, want: true, wantSeq: 1},
+			{world: []int{1}, input: 1, ack: true, want: true, wantSeq: 2},
+			{world: []int{1}, input: 1, want: false},
+		}},
+		{"join after snapshots", []step{
+			{world: []int{1}, ack: true, want: true, wantSeq: 1},
+			{world: []int{1}, join: true, ack: true, want: true, wantSeq: 2},
+			{world: []int{2}, ack: true, want: true, wantSeq: 3},
+			{world: nil, ack: true, want: true, wantSeq: 4},
+		}},
+	}
+
+	for _, tt := range tests {
+		cv := NewClientView()
+		fc := &fakeClient{states: map[uint64]game.WorldState{0: {}}}
+
+		for i, s := range tt.steps {
+			cur := worldWith(s.world...)
+
+			var snap *game.Snapshot
+			if s.join {
+				snap = cv.JoinSnapshot(cur, s.input, 0)
+			} else {
+				snap = cv.Snapshot(cur, s.input, 0)
+			}
+
+			if (snap != nil) != s.want {
+				t.Fatalf("%s: step %d: got snapshot %v, want one: %t", tt.name, i, snap, s.want)
+			}
+
+			if snap == nil {
+				continue
+			}
+
+			if snap.Seq != s.wantSeq {
+				t.Errorf("%s: step %d: seq %d, want %d", tt.name, i, snap.Seq, s.wantSeq)
+			}
+
+			if snap.InputAck != s.input {
+				t.Errorf("%s: step %d: input ack %d, want %d", tt.name, i, snap.InputAck, s.input)
+			}
+
+			fc.apply(t, snap)
+
+			if got := fc.states[snap.Seq]; len(got.Diff(cur)) != 0 {
+				t.Errorf("%s: step %d: client is %d deltas behind", tt.name, i, len(got.Diff(cur)))
+			}
+
+			if s.ack {
+				cv.Ack(snap.Seq)
+				if cv.AckSeq != snap.Seq {
+					t.Errorf("%s: step %d: AckSeq %d, want %d", tt.name, i, cv.AckSeq, snap.Seq)
+				}
+			}
+		}
+	}
+}
+
+func TestClientViewAck(t *testing.T) {
+	cv := NewClientView()
+
+	first := cv.Snapshot(worldWith(1), 0, 0)
+	second := cv.Snapshot(worldWith(1, 2), 0, 0)
+
+	// one we never sent changes nothing
+	cv.Ack(99)
+	if cv.AckSeq != 0 {
+		t.Fatalf("AckSeq %d after acking an unsent state", cv.AckSeq)
+	}
+
+	// acks may arrive out of order, the older one is forgotten by then
+	cv.Ack(second.Seq)
+	cv.Ack(first.Seq)
+	if cv.AckSeq != second.Seq {
+		t.Fatalf("AckSeq %d, want %d", cv.AckSeq, second.Seq)
+	}
+
+	third := cv.Snapshot(worldWith(2), 0, 0)
+	if third.Base != second.Seq {
+		t.Errorf("base %d, want %d", third.Base, second.Seq)
+	}
+
+	if third.Seq <= second.Seq {
+		t.Errorf("seq %d reused after %d", third.Seq, second.Seq)
+	}
+
+	if len(third.Deltas) != 1 || third.Deltas[0].ID != 1 || third.Deltas[0].Fields&game.DELTA_REMOVED == 0 {
+		t.Errorf("deltas %v, want 1 removed", third.Deltas)
+	}
+}
@@ -0,0 +1,97 @@
+// Spectators: sessions that asked for the "spectate" feature get the
+// world like everyone else but no player. They see every player wherever
+// they are, and whatever is around their camera, which they move with
+// Tcamera.
+package main
+
+import (
+	"fmt"
+	"github.com/mischief/goland/game"
+	"github.com/mischief/goland/game/gnet"
+	"image"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Spectate lets ws watch the world without a player. Only called from
+// the router.
+func (gs *GameServer) Spectate(ws *WorldSession) {
+	log.Printf("GameServer: Spectate: %s is spectating", ws.Username)
+
+	ws.Spectator = true
+	ws.Camera = game.Camera{Pos: image.Pt(game.MAP_WIDTH/2, game.MAP_HEIGHT/2)}
+	gs.Spectators[ws] = true
+
+	gs.Join(ws)
+
+	ws.SendPacket(gnet.NewPacket("Rchat", "You are spectating. Type /who to see who's here."))
+}
+
+// Tcamera: a spectator looks somewhere else
+func (gs *GameServer) HandleCameraPacket(cp *ClientPacket) error {
+	if !cp.Client.Spectator {
+		return fmt.Errorf("only spectators can move the camera")
+	}
+
+	cp.Client.Camera = *cp.Data.(*game.Camera)
+	return nil
+}
+
+// where ws's client is looking from: its player, or for spectators the
+// object they follow or their camera. ok is false if it has neither.
+func (gs *GameServer) ViewCenter(ws *WorldSession) (pt image.Point, ok bool) {
+	if ws.Player != nil {
+		return image.Pt(ws.Player.GetPos()), true
+	}
+
+	if !ws.Spectator {
+		return image.ZP, false
+	}
+
+	if ws.Camera.Follow != 0 {
+		if o := gs.Objects.FindObjectByID(ws.Camera.Follow); o != nil {
+			return image.Pt(o.GetPos()), true
+		}
+	}
+
+	return ws.Camera.Pos, true
+}
+
+// Players is everyone with a player in the world, by name
+func (gs *GameServer) Players() []string {
+	var names []string
+	for name, ws := range gs.Online {
+		if ws.Player != nil {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// SpectatorNames is everyone watching, by name
+func (gs *GameServer) SpectatorNames() []string {
+	var names []string
+	for ws := range gs.Spectators {
+		names = append(names, ws.Username)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// /who: tell the client who's playing and who's watching
+func (gs *GameServer) Who(cp *ClientPacket) {
+	list := func(what string, names []string) string {
+		if len(names) == 0 {
+			return fmt.Sprintf("No %s.", what)
+		}
+
+		return fmt.Sprintf("%d %s: %s", len(names), what, strings.Join(names, ", "))
+	}
+
+	cp.Reply(gnet.NewPacket("Rchat", list("players", gs.Players())))
+	cp.Reply(gnet.NewPacket("Rchat", list("spectators", gs.SpectatorNames())))
+}
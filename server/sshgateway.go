@@ -0,0 +1,330 @@
+// SSH gateway: serve the game to anyone with an ssh client, without
+// handing out shell accounts.
+//
+// each SSH session is drawn by an SSHTerm, playing through a bot that's
+// attached to its own WorldSession over a pipe. the ssh login is the game
+// login, so the session doesn't log in again.
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"github.com/mischief/goland/game/bot"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// client name in the hello of ssh sessions
+const SSH_CLIENT_NAME = "goland-ssh"
+
+// payload of a pty-req channel request, RFC 4254 6.2
+type sshPtyRequest struct {
+	Term    string
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+	Modes   string
+}
+
+// payload of a window-change channel request, RFC 4254 6.7
+type sshWindowChange struct {
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+}
+
+// payload of an exit-status channel request, RFC 4254 6.10
+type sshExitStatus struct {
+	Status uint32
+}
+
+// SSHGateway accepts ssh connections and plays the game in each session
+type SSHGateway struct {
+	Listener net.Listener
+	Config   *ssh.ServerConfig
+
+	world *GameServer
+}
+
+// one end of a net.Pipe that says it's the ssh client, so bans, throttles
+// and logs see the real address
+type sshPipe struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (p sshPipe) RemoteAddr() net.Addr {
+	return p.remote
+}
+
+// start the optional SSH gateway if 'ssh' is in the config
+func (gs *GameServer) StartSSH() {
+	addrconf, err := gs.config.Get("ssh", reflect.String)
+	if err != nil {
+		log.Printf("GameServer: StartSSH: not starting: %s", err)
+		return
+	}
+
+	sg := &SSHGateway{world: gs}
+
+	signer, err := LoadHostKey(gs.configString("sshhostkey", "ssh_host_key"))
+	if err != nil {
+		log.Printf("GameServer: StartSSH: %s", err)
+		return
+	}
+
+	// ssh logins are game logins. ssh can't ask to register, so a name
+	// nobody has yet becomes a new account when its first session starts.
+	// each session counts as a login, so here we only check the password.
+	sg.Config = &ssh.ServerConfig{}
+	sg.Config.PasswordCallback = func(c ssh.ConnMetadata, pw []byte) (*ssh.Permissions, error) {
+		if why, ok := checkUsername(c.User()); !ok {
+			return nil, fmt.Errorf("%s", why)
+		}
+
+		addr := hostOf(c.RemoteAddr())
+		if left, banned := gs.Bans.Banned(c.User(), addr); banned {
+			return nil, fmt.Errorf("banned for another %s", left/time.Second*time.Second)
+		}
+
+		if left, ok := gs.Logins.Allow(addr, c.User()); !ok {
+			return nil, fmt.Errorf("too many failed logins, try again in %s", left/time.Second*time.Second+time.Second)
+		}
+
+		register := false
+		_, err := gs.Accounts.Verify(c.User(), string(pw))
+		if err == ErrNoAccount {
+			register = true
+			err = checkPassword(string(pw))
+		}
+
+		if err != nil {
+			log.Printf("SSHGateway: %s can't log in as %s: %s", c.RemoteAddr(), c.User(), err)
+			if err == ErrBadPassword {
+				gs.Logins.Failed(addr, c.User())
+			}
+
+			return nil, ErrBadLogin
+		}
+
+		gs.Logins.Succeeded(c.User())
+
+		return &ssh.Permissions{Extensions: map[string]string{
+			"password": string(pw),
+			"register": strconv.FormatBool(register),
+		}}, nil
+	}
+
+	sg.Config.AddHostKey(signer)
+
+	if sg.Listener, err = net.Listen("tcp", addrconf.(string)); err != nil {
+		log.Printf("GameServer: StartSSH: %s", err)
+		return
+	}
+
+	gs.Listeners = append(gs.Listeners, sg.Listener)
+
+	log.Printf("GameServer: StartSSH: listening on %s", sg.Listener.Addr())
+
+	go sg.Run()
+}
+
+// LoadHostKey reads the ssh host key from file, making a new one if there isn't one
+func LoadHostKey(file string) (ssh.Signer, error) {
+	if b, err := ioutil.ReadFile(file); err == nil {
+		return ssh.ParsePrivateKey(b)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	log.Printf("LoadHostKey: generating new host key in %s", file)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := ssh.MarshalPrivateKey(key, "goland host key")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, err
+	}
+
+	return ssh.NewSignerFromKey(key)
+}
+
+func (sg *SSHGateway) Run() {
+	for {
+		conn, err := sg.Listener.Accept()
+		if err != nil {
+			log.Printf("SSHGateway: Run: %s", err)
+			return
+		}
+
+		go sg.HandleConn(conn)
+	}
+}
+
+func (sg *SSHGateway) HandleConn(c net.Conn) {
+	sconn, chans, reqs, err := ssh.NewServerConn(c, sg.Config)
+	if err != nil {
+		log.Printf("SSHGateway: HandleConn: %s: %s", c.RemoteAddr(), err)
+		return
+	}
+
+	defer sconn.Close()
+
+	log.Printf("SSHGateway: HandleConn: %s logged in as %s", sconn.RemoteAddr(), sconn.User())
+
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+
+		ch, requests, err := nc.Accept()
+		if err != nil {
+			log.Printf("SSHGateway: HandleConn: %s", err)
+			continue
+		}
+
+		ext := sconn.Permissions.Extensions
+		go sg.HandleSession(sconn, ext["password"], ext["register"] == "true", ch, requests)
+	}
+}
+
+// log the ssh user in for one session. the password was checked when the
+// connection was made, or the name had no account then.
+func (sg *SSHGateway) login(user, password string, register bool) (*Account, error) {
+	if register {
+		a, err := sg.world.Accounts.Register(user, password)
+		if err != ErrAccountExists {
+			return a, err
+		}
+
+		// an earlier session on this connection made it, or someone else
+		// took the name since. only the first is us.
+		if _, err := sg.world.Accounts.Verify(user, password); err != nil {
+			return nil, ErrBadLogin
+		}
+	}
+
+	return sg.world.Accounts.CountLogin(user)
+}
+
+// Attach starts a session for user, who logged in over ssh, and joins the
+// world through a bot on the other end of a pipe
+func (sg *SSHGateway) Attach(conn ssh.ConnMetadata, password string, register bool) (*bot.Bot, error) {
+	acct, err := sg.login(conn.User(), password, register)
+	if err != nil {
+		return nil, err
+	}
+
+	server, client := net.Pipe()
+
+	ws := NewWorldSession(sg.world, sshPipe{server, conn.RemoteAddr()})
+	if ws == nil {
+		server.Close()
+		client.Close()
+		return nil, fmt.Errorf("can't make a session")
+	}
+
+	ws.Preauth = acct
+
+	log.Printf("SSHGateway: Attach: %s playing as %s", conn.RemoteAddr(), acct.Name)
+
+	go ws.ReceiveProc()
+
+	return bot.DialConn(client, &bot.Config{Username: acct.Name, Name: SSH_CLIENT_NAME, Version: SERVER_VERSION})
+}
+
+// serve one session channel. we only do pty-req, window-change and shell.
+func (sg *SSHGateway) HandleSession(conn ssh.ConnMetadata, password string, register bool, ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+
+	var term *SSHTerm
+	var b *bot.Bot
+	cols, rows := 80, 24
+
+	for req := range reqs {
+		switch req.Type {
+		case "pty-req":
+			var pr sshPtyRequest
+			if err := ssh.Unmarshal(req.Payload, &pr); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+
+			cols, rows = int(pr.Columns), int(pr.Rows)
+			req.Reply(true, nil)
+
+		case "window-change":
+			var wc sshWindowChange
+			if err := ssh.Unmarshal(req.Payload, &wc); err != nil {
+				continue
+			}
+
+			cols, rows = int(wc.Columns), int(wc.Rows)
+			if term != nil {
+				term.Resize(cols, rows)
+			}
+
+		case "shell":
+			if term != nil {
+				req.Reply(false, nil)
+				continue
+			}
+
+			var err error
+			if b, err = sg.Attach(conn, password, register); err != nil {
+				log.Printf("SSHGateway: HandleSession: %s: %s", conn.User(), err)
+				fmt.Fprintf(ch.Stderr(), "can't join the game: %s\r\n", err)
+				req.Reply(false, nil)
+				return
+			}
+
+			term = NewSSHTerm(ch, b, cols, rows)
+			req.Reply(true, nil)
+
+			go func() {
+				status := 0
+				if reason := term.Run(ch); reason != "" {
+					io.WriteString(ch, reason+"\r\n")
+					status = 1
+				}
+
+				log.Printf("SSHGateway: HandleSession: %s left", conn.User())
+
+				ch.SendRequest("exit-status", false, ssh.Marshal(&sshExitStatus{uint32(status)}))
+				ch.Close()
+			}()
+
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+
+	// the channel is gone. don't leave our player in the world without
+	// anyone; closing the bot closes the pipe and so the WorldSession.
+	if b != nil {
+		b.Close()
+	}
+}
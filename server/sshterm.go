@@ -0,0 +1,407 @@
+// SSH terminal: the game drawn on an ssh session's pty with plain ANSI
+// escapes. termbox keeps one global terminal per process, so the termbox
+// client can't run once per session inside the server. Instead each
+// session plays through a bot, which keeps its copy of the world for us
+// to draw.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mischief/goland/game"
+	"github.com/mischief/goland/game/bot"
+	"github.com/nsf/termbox-go"
+	"image"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// lines of chat and messages under the map
+	SSH_LOG_LINES = 5
+
+	// most redraws a second
+	SSH_FPS = 20
+
+	// longest chat line we let anyone type
+	SSH_CHAT_MAX = 200
+
+	// alternate screen and hidden cursor while playing, and back after
+	ANSI_START = "\x1b[?1049h\x1b[?25l\x1b[2J"
+	ANSI_END   = "\x1b[0m\x1b[?25h\x1b[?1049l"
+
+	SSH_HELP = "wasd/hjkl/arrows move  , pick up  x drop  i inventory  enter chat  esc quit"
+)
+
+var (
+	// the arrow keys' escape sequences
+	sshArrows = map[string]game.Action{
+		"\x1b[A": game.DIR_UP,
+		"\x1b[B": game.DIR_DOWN,
+		"\x1b[C": game.DIR_RIGHT,
+		"\x1b[D": game.DIR_LEFT,
+		"\x1bOA": game.DIR_UP,
+		"\x1bOB": game.DIR_DOWN,
+		"\x1bOC": game.DIR_RIGHT,
+		"\x1bOD": game.DIR_LEFT,
+	}
+)
+
+// SSHTerm is one ssh session's screen and keyboard
+type SSHTerm struct {
+	out io.Writer
+	bot *bot.Bot
+
+	w, h  int // terminal size
+	sized bool
+	sm    sync.Mutex // protects the size, which the session's requests change
+
+	log      []string // chat and messages, newest last
+	chatting bool     // typing a chat line
+	line     []rune   // what's been typed of it
+	dirty    bool     // something to draw
+}
+
+func NewSSHTerm(out io.Writer, b *bot.Bot, w, h int) *SSHTerm {
+	return &SSHTerm{out: out, bot: b, w: w, h: h, dirty: true}
+}
+
+// Resize is for window-change requests
+func (t *SSHTerm) Resize(w, h int) {
+	t.sm.Lock()
+	t.w, t.h, t.sized = w, h, true
+	t.sm.Unlock()
+}
+
+// Run plays until the player quits, in hangs up or the server does. It
+// returns why the server hung up, or "" if the player left.
+func (t *SSHTerm) Run(in io.Reader) string {
+	io.WriteString(t.out, ANSI_START)
+	defer io.WriteString(t.out, ANSI_END)
+
+	keys := make(chan []byte)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go t.readKeys(in, keys, stop)
+
+	tick := time.NewTicker(time.Second / SSH_FPS)
+	defer tick.Stop()
+
+	var reason string
+	events := t.bot.Events()
+
+	for {
+		select {
+		case k, ok := <-keys:
+			if !ok || !t.HandleKeys(k) {
+				// our player leaves the world with us
+				t.bot.Close()
+				return ""
+			}
+
+		case ev, ok := <-events:
+			if !ok {
+				return reason
+			}
+
+			switch ev.Kind {
+			case bot.EVENT_CHAT, bot.EVENT_ERROR:
+				t.Log(ev.Text)
+			case bot.EVENT_BYE:
+				reason = ev.Text
+			case bot.EVENT_DISCONNECT:
+				if reason == "" {
+					reason = fmt.Sprintf("Lost the server: %s", ev.Err)
+				}
+			}
+
+			t.dirty = true
+
+		case <-tick.C:
+			t.sm.Lock()
+			if t.sized {
+				// stale parts of a bigger or smaller screen
+				t.sized = false
+				t.dirty = true
+				io.WriteString(t.out, "\x1b[2J")
+			}
+			t.sm.Unlock()
+
+			if t.dirty {
+				t.dirty = false
+				t.Draw()
+			}
+		}
+	}
+}
+
+// pass along what's typed until in goes away or Run stops listening
+func (t *SSHTerm) readKeys(in io.Reader, keys chan<- []byte, stop <-chan struct{}) {
+	defer close(keys)
+
+	buf := make([]byte, 256)
+	for {
+		n, err := in.Read(buf)
+		if err != nil {
+			return
+		}
+
+		k := make([]byte, n)
+		copy(k, buf[:n])
+
+		select {
+		case keys <- k:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Log adds a line under the map
+func (t *SSHTerm) Log(line string) {
+	t.log = append(t.log, line)
+	if len(t.log) > SSH_LOG_LINES {
+		t.log = t.log[len(t.log)-SSH_LOG_LINES:]
+	}
+}
+
+// HandleKeys does what one read's worth of keys say. It returns false
+// to quit.
+func (t *SSHTerm) HandleKeys(k []byte) bool {
+	s := string(k)
+
+	// ctrl-c always gets you out
+	if strings.IndexByte(s, 0x03) >= 0 {
+		return false
+	}
+
+	// a lone escape is the key, anything longer is a sequence like an
+	// arrow. terminals send a whole sequence in one write.
+	if s == "\x1b" {
+		if t.chatting {
+			t.chatting = false
+			t.line = nil
+			t.dirty = true
+			return true
+		}
+
+		return false
+	}
+
+	if strings.HasPrefix(s, "\x1b") {
+		if a, ok := sshArrows[s]; ok && !t.chatting {
+			t.bot.Act(a)
+		}
+
+		return true
+	}
+
+	for _, r := range s {
+		if t.chatting {
+			t.chatKey(r)
+			continue
+		}
+
+		if r == '\r' || r == '\n' {
+			t.chatting = true
+			t.dirty = true
+		} else if a, ok := game.KeyActions[r]; ok {
+			t.bot.Act(a)
+		}
+	}
+
+	return true
+}
+
+// a key typed while chatting
+func (t *SSHTerm) chatKey(r rune) {
+	t.dirty = true
+
+	switch {
+	case r == '\r' || r == '\n':
+		if len(t.line) > 0 {
+			t.bot.Chat(string(t.line))
+		}
+		t.chatting = false
+		t.line = nil
+	case r == 0x7f || r == 0x08:
+		if len(t.line) > 0 {
+			t.line = t.line[:len(t.line)-1]
+		}
+	case r == 0x15:
+		// ctrl-u
+		t.line = nil
+	case unicode.IsPrint(r) && len(t.line) < SSH_CHAT_MAX:
+		t.line = append(t.line, r)
+	}
+}
+
+// the SGR escape for a cell's colors and attributes
+func sgr(fg, bg termbox.Attribute) string {
+	codes := []string{"0"}
+
+	if fg&termbox.AttrBold != 0 {
+		codes = append(codes, "1")
+	}
+	if fg&termbox.AttrUnderline != 0 {
+		codes = append(codes, "4")
+	}
+	if fg&termbox.AttrReverse != 0 {
+		codes = append(codes, "7")
+	}
+
+	if c := fg & 0x1ff; c != termbox.ColorDefault {
+		codes = append(codes, ansiColor(c, 30))
+	}
+	if c := bg & 0x1ff; c != termbox.ColorDefault {
+		codes = append(codes, ansiColor(c, 40))
+	}
+
+	return "\x1b[" + strings.Join(codes, ";") + "m"
+}
+
+// termbox's colors count from black at 1, then the bright ones, then
+// the rest of the 256
+func ansiColor(c termbox.Attribute, base int) string {
+	switch {
+	case c <= termbox.ColorWhite:
+		return strconv.Itoa(base + int(c-termbox.ColorBlack))
+	case c <= termbox.ColorWhite+8:
+		return strconv.Itoa(base + 60 + int(c-termbox.ColorWhite-1))
+	}
+
+	return fmt.Sprintf("%d;5;%d", base+8, int(c)-1)
+}
+
+// s cut or padded to w columns
+func fit(s string, w int) string {
+	if n := utf8.RuneCountInString(s); n < w {
+		return s + strings.Repeat(" ", w-n)
+	}
+
+	return string([]rune(s)[:w])
+}
+
+// Draw puts the whole screen out: a status line, the map around our
+// player, the log and the key help or the chat line being typed
+func (t *SSHTerm) Draw() {
+	t.sm.Lock()
+	w, h := t.w, t.h
+	t.sm.Unlock()
+
+	viewh := h - SSH_LOG_LINES - 2
+	if w < 1 || viewh < 1 {
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[H")
+
+	center := image.Pt(game.MAP_WIDTH/2, game.MAP_HEIGHT/2)
+	status := "goland: waiting for the world"
+	if p, ok := t.bot.Player(); ok {
+		center = p.Pos
+		status = fmt.Sprintf("goland: %s at %d,%d  rtt %s", p.Name, p.Pos.X, p.Pos.Y, t.bot.RTT()/time.Millisecond*time.Millisecond)
+	}
+
+	buf.WriteString(sgr(termbox.AttrReverse, 0))
+	buf.WriteString(fit(status, w))
+	buf.WriteString(sgr(0, 0))
+	buf.WriteString("\r\n")
+
+	// the view's top left in the world
+	origin := center.Sub(image.Pt(w/2, viewh/2))
+	view := image.Rectangle{origin, origin.Add(image.Pt(w, viewh))}
+
+	cells := make([]termbox.Cell, w*viewh)
+	for i := range cells {
+		cells[i].Ch = ' '
+	}
+
+	set := func(pt image.Point, c termbox.Cell) {
+		if pt.In(view) {
+			if c.Ch == 0 {
+				c.Ch = ' '
+			}
+			cells[(pt.Y-origin.Y)*w+pt.X-origin.X] = c
+		}
+	}
+
+	if m := t.bot.Map(); m != nil {
+		r := view.Intersect(m.Rect)
+		for x := r.Min.X; x < r.Max.X; x++ {
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				if terr, ok := m.GetTerrain(image.Pt(x, y)); ok && terr != nil {
+					set(image.Pt(x, y), terr.Glyph)
+				}
+			}
+		}
+	}
+
+	// players on top of what they stand on
+	me := t.bot.PlayerID()
+	var players []*game.ObjectState
+	for id, st := range t.bot.World() {
+		if !st.Tags["visible"] {
+			continue
+		}
+
+		if id == me || st.Tags["player"] {
+			players = append(players, st)
+		} else {
+			set(st.Pos, st.Glyph)
+		}
+	}
+
+	for _, st := range players {
+		set(st.Pos, st.Glyph)
+	}
+
+	if me != 0 {
+		if st, ok := t.bot.Player(); ok {
+			set(st.Pos, st.Glyph)
+		}
+	}
+
+	var fg, bg termbox.Attribute
+	for y := 0; y < viewh; y++ {
+		for x := 0; x < w; x++ {
+			c := cells[y*w+x]
+			if c.Fg != fg || c.Bg != bg {
+				fg, bg = c.Fg, c.Bg
+				buf.WriteString(sgr(fg, bg))
+			}
+			buf.WriteRune(c.Ch)
+		}
+
+		fg, bg = 0, 0
+		buf.WriteString(sgr(0, 0))
+		buf.WriteString("\r\n")
+	}
+
+	for i := 0; i < SSH_LOG_LINES; i++ {
+		line := ""
+		if j := len(t.log) - SSH_LOG_LINES + i; j >= 0 {
+			line = t.log[j]
+		}
+
+		buf.WriteString(fit(line, w))
+		buf.WriteString("\r\n")
+	}
+
+	if t.chatting {
+		buf.WriteString(fit("say: "+string(t.line), w))
+	} else {
+		buf.WriteString(sgr(termbox.AttrBold, 0))
+		buf.WriteString(fit(SSH_HELP, w))
+		buf.WriteString(sgr(0, 0))
+	}
+
+	t.out.Write(buf.Bytes())
+}
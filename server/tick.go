@@ -0,0 +1,90 @@
+// Tick: the server's fixed rate game loop. Player actions, object updates
+// and scripts all run here, on the router, and everything that changed
+// goes out to clients as one Rsnapshot per tick.
+package main
+
+import (
+	"github.com/mischief/goland/game"
+	"log"
+	"time"
+)
+
+const (
+	// ticks per second
+	DEFAULT_TICK_RATE = 10
+)
+
+// Ticker feeds the router's Tick port every TickInterval. if a tick runs
+// long the next one is late rather than doubled up. On shutdown it closes
+// the port.
+func (gs *GameServer) Ticker() {
+	t := time.NewTicker(gs.TickInterval)
+	defer t.Stop()
+	defer close(gs.TickChan)
+
+	for {
+		select {
+		case now := <-t.C:
+			select {
+			case gs.TickChan <- now:
+			case <-gs.stopTick:
+				return
+			}
+		case <-gs.stopTick:
+			return
+		}
+	}
+}
+
+// Clock is the simulation's time: how many ticks have run, times
+// TickInterval. clients time their interpolation by it.
+func (gs *GameServer) Clock() time.Duration {
+	return time.Duration(gs.TickCount) * gs.TickInterval
+}
+
+// Tick advances the world by one fixed step. Only called from the router.
+func (gs *GameServer) Tick() {
+	gs.TickCount++
+
+	gs.RunIntents()
+
+	for o := range gs.Objects.Chan() {
+		o.Update(gs.TickInterval)
+	}
+
+	if gs.tickfn != nil {
+		if _, err := gs.tickfn.Call(gs.TickCount); err != nil {
+			log.Printf("GameServer: Tick: Lua error: %s", err)
+		}
+	}
+
+	gs.SendSnapshots()
+
+	// SendSnapshots brought State up to date
+	gs.Match.Record(gs.TickCount, gs.State)
+
+	if gs.AutosaveEvery > 0 && gs.TickCount%gs.AutosaveEvery == 0 {
+		gs.Autosave()
+	}
+}
+
+// run the Tactions queued since the last tick, oldest first
+func (gs *GameServer) RunIntents() {
+	intents := gs.Intents
+	gs.Intents = nil
+
+	for _, cp := range intents {
+		input := cp.Data.(*game.Input)
+		if input.Seq > cp.Client.LastInput {
+			cp.Client.LastInput = input.Seq
+		}
+
+		// the player may have left the world since asking
+		p := cp.Client.Player
+		if p == nil || gs.Objects.FindObjectByID(p.GetID()) == nil {
+			continue
+		}
+
+		gs.RunAction(cp)
+	}
+}
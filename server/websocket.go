@@ -0,0 +1,85 @@
+// WebSocket gateway: lets browsers join the same world as termbox clients.
+// Each WebSocket message carries one jsonl packet.
+package main
+
+import (
+	"golang.org/x/net/websocket"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+)
+
+// frameConn makes each incoming WebSocket message look like one
+// newline terminated line, which is what the jsonl codec reads.
+// Writes already go out one message per packet.
+type frameConn struct {
+	*websocket.Conn
+	buf []byte
+}
+
+func (fc *frameConn) Read(p []byte) (int, error) {
+	if len(fc.buf) == 0 {
+		var msg []byte
+		if err := websocket.Message.Receive(fc.Conn, &msg); err != nil {
+			return 0, err
+		}
+		fc.buf = append(msg, '\n')
+	}
+
+	n := copy(p, fc.buf)
+	fc.buf = fc.buf[n:]
+	return n, nil
+}
+
+// start the optional WebSocket listener if 'websocket' is in the config.
+// if 'wwwroot' is set, its files are served too, so the browser
+// front-end and the socket share an origin.
+func (gs *GameServer) StartWebSocket() {
+	addrconf, err := gs.config.Get("websocket", reflect.String)
+	if err != nil {
+		log.Printf("GameServer: StartWebSocket: not starting: %s", err)
+		return
+	}
+
+	addr := addrconf.(string)
+
+	mux := http.NewServeMux()
+	mux.Handle("/ws", websocket.Handler(gs.HandleWebSocket))
+
+	if root, err := gs.config.Get("wwwroot", reflect.String); err == nil {
+		log.Printf("GameServer: StartWebSocket: serving files from %s", root)
+		mux.Handle("/", http.FileServer(http.Dir(root.(string))))
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("GameServer: StartWebSocket: %s", err)
+		return
+	}
+
+	// so shutdown can stop it
+	gs.Listeners = append(gs.Listeners, l)
+
+	log.Printf("GameServer: StartWebSocket: listening on %s", addr)
+
+	go func() {
+		if err := http.Serve(l, mux); err != nil && !gs.Closing() {
+			log.Printf("GameServer: StartWebSocket: %s", err)
+		}
+	}()
+}
+
+// run a WorldSession over a browser's WebSocket.
+// the session sniffs jsonl from the first message, just like a tool on TCP.
+func (gs *GameServer) HandleWebSocket(conn *websocket.Conn) {
+	ws := NewWorldSession(gs, &frameConn{Conn: conn})
+	if ws == nil {
+		return
+	}
+
+	log.Printf("GameServer: New WebSocket connection from %s", conn.Request().RemoteAddr)
+
+	// the http server closes the socket when we return
+	ws.ReceiveProc()
+}
@@ -0,0 +1,294 @@
+// World saves: the map, every object lying around and the scripts' own
+// state go to one json file now and then, and the server picks up from it
+// when it starts again. Players aren't in it, they're saved to their
+// accounts.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mischief/goland/game"
+	"image"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	// bump this whenever WorldSave changes, and add a migration from the
+	// old version to SaveMigrations
+	SAVE_VERSION = 2
+
+	DEFAULT_SAVE_FILE = "world.json"
+	DEFAULT_AUTOSAVE  = 5 * time.Minute
+)
+
+// a migration upgrades a save from one version to the next, in its raw
+// json form, so old saves don't have to match the current WorldSave
+type SaveMigration func(save map[string]interface{}) error
+
+var (
+	// SaveMigrations[n] turns a version n save into version n+1
+	SaveMigrations = map[int]SaveMigration{
+		1: migrateSave1,
+	}
+)
+
+// version 1 didn't save the ID allocator, so carry on past every ID in it
+func migrateSave1(save map[string]interface{}) error {
+	max := 0
+
+	var walk func(objs interface{})
+	walk = func(objs interface{}) {
+		list, _ := objs.([]interface{})
+		for _, o := range list {
+			obj, ok := o.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			if id, ok := obj["ID"].(float64); ok && int(id) > max {
+				max = int(id)
+			}
+
+			walk(obj["SubObjects"])
+		}
+	}
+
+	walk(save["Objects"])
+
+	save["NextID"] = max + 1
+	return nil
+}
+
+// WorldSave is what goes in the save file. Version comes first so
+// anything can tell what it's looking at.
+type WorldSave struct {
+	Version int                // SAVE_VERSION of the server that wrote it
+	Saved   time.Time          // when
+	Tick    uint64             // the server's TickCount
+	NextID  int                // where the server's IDs got to
+	Map     *game.MapChunk     // terrain
+	Objects []*game.GameObject // everything in the world except players
+	Script  string             // what lua's onsave returned, for onload
+}
+
+// write b to path. the old file stays until the new one is complete.
+func writeFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// SaveWorld writes the world to SaveFile. Only called from the router.
+func (gs *GameServer) SaveWorld() error {
+	save := &WorldSave{
+		Version: SAVE_VERSION,
+		Saved:   time.Now(),
+		Tick:    gs.TickCount,
+		NextID:  gs.IDs.Peek(),
+		Map:     gs.Map,
+	}
+
+	// players and what they carry are saved to their accounts, except the
+	// world's things, which are saved lying where their carrier stands
+	carried := make(map[int]bool)
+	for o := range gs.Objects.Chan() {
+		if !o.GetTag("player") {
+			continue
+		}
+
+		carried[o.GetID()] = true
+		for sub := range o.GetSubObjects().Chan() {
+			carried[sub.GetID()] = true
+
+			if gob, ok := sub.(*game.GameObject); ok && gob.GetTag("worlditem") {
+				dropped := gob.Copy()
+				dropped.Pos = image.Pt(o.GetPos())
+				dropped.Tags["visible"] = true
+				dropped.Tags["gettable"] = true
+				save.Objects = append(save.Objects, dropped)
+			}
+		}
+	}
+
+	for o := range gs.Objects.Chan() {
+		if gob, ok := o.(*game.GameObject); ok && !carried[o.GetID()] {
+			save.Objects = append(save.Objects, gob.Copy())
+		}
+	}
+
+	if onsave := gs.luaFunc("onsave"); onsave != nil {
+		res, err := onsave.Call()
+		if err != nil {
+			log.Printf("GameServer: SaveWorld: Lua error: %s", err)
+		} else if s, ok := res.(string); ok {
+			save.Script = s
+		}
+	}
+
+	b, err := json.Marshal(save)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(gs.SaveFile, b); err != nil {
+		return err
+	}
+
+	log.Printf("GameServer: SaveWorld: saved %d objects to %s", len(save.Objects), gs.SaveFile)
+
+	return nil
+}
+
+// Autosave saves the world and everyone's characters. Only called from the router.
+func (gs *GameServer) Autosave() {
+	if err := gs.SaveWorld(); err != nil {
+		log.Printf("GameServer: Autosave: %s", err)
+	}
+
+	for _, ws := range gs.Online {
+		gs.SaveCharacter(ws)
+	}
+}
+
+// read a save, upgrading it to SAVE_VERSION if it's older
+func ReadWorldSave(path string) (*WorldSave, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+
+	version, ok := raw["Version"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("%s has no save version", path)
+	}
+
+	v := int(version)
+	if v > SAVE_VERSION {
+		return nil, fmt.Errorf("%s is save version %d, newer than ours (%d)", path, v, SAVE_VERSION)
+	}
+
+	for ; v < SAVE_VERSION; v++ {
+		migrate, ok := SaveMigrations[v]
+		if !ok {
+			return nil, fmt.Errorf("don't know how to upgrade save version %d", v)
+		}
+
+		if err := migrate(raw); err != nil {
+			return nil, fmt.Errorf("upgrading save version %d: %s", v, err)
+		}
+
+		log.Printf("ReadWorldSave: upgraded %s from version %d to %d", path, v, v+1)
+		raw["Version"] = v + 1
+	}
+
+	// round trip the upgraded form into the real thing
+	if b, err = json.Marshal(raw); err != nil {
+		return nil, err
+	}
+
+	save := new(WorldSave)
+	if err := json.Unmarshal(b, save); err != nil {
+		return nil, err
+	}
+
+	return save, nil
+}
+
+// LoadWorld replaces the world the scripts just built with the one in
+// SaveFile, if there is one. Only called from LoadAssets.
+func (gs *GameServer) LoadWorld() error {
+	save, err := ReadWorldSave(gs.SaveFile)
+	if os.IsNotExist(err) {
+		log.Printf("GameServer: LoadWorld: no save in %s, starting fresh", gs.SaveFile)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("can't load %s: %s", gs.SaveFile, err)
+	}
+
+	if save.Map != nil {
+		gs.Map = save.Map
+	}
+
+	// carry on from where the saved world's ids got to
+	gs.IDs.Reserve(save.NextID - 1)
+
+	for o := range gs.Objects.Chan() {
+		gs.Objects.RemoveObject(o)
+	}
+
+	// carried objects are in the world too, so match them up by id
+	restored := make(map[int]game.Object)
+	for _, saved := range save.Objects {
+		o := restoreObject(saved)
+		gs.restoreID(o, saved.ID)
+		restored[saved.ID] = o
+	}
+
+	for _, saved := range save.Objects {
+		o := restored[saved.ID]
+		if saved.SubObjects == nil {
+			continue
+		}
+
+		for sub := range saved.SubObjects.Chan() {
+			if so, ok := restored[sub.GetID()]; ok {
+				o.AddSubObject(so)
+			} else if sg, ok := sub.(*game.GameObject); ok {
+				so := restoreObject(sg)
+				gs.restoreID(so, sg.ID)
+				o.AddSubObject(so)
+			}
+		}
+	}
+
+	for _, o := range restored {
+		gs.Objects.Add(o)
+	}
+
+	gs.TickCount = save.Tick
+
+	if onload := gs.luaFunc("onload"); onload != nil && save.Script != "" {
+		if _, err := onload.Call(save.Script); err != nil {
+			log.Printf("GameServer: LoadWorld: Lua error: %s", err)
+		}
+	}
+
+	log.Printf("GameServer: LoadWorld: restored %d objects from %s, saved %s", len(restored), gs.SaveFile, save.Saved)
+
+	return nil
+}
+
+// a new object like saved, sub objects aside. see restoreID for its id.
+func restoreObject(saved *game.GameObject) game.Object {
+	o := game.NewGameObject(saved.Name)
+	o.(*game.GameObject).ItemID = saved.ItemID
+	o.SetPos(saved.Pos.X, saved.Pos.Y)
+	o.SetGlyph(saved.Glyph)
+
+	for tag, val := range saved.Tags {
+		o.SetTag(tag, val)
+	}
+
+	return o
+}
+
+// give o, which isn't in the world yet, id back if it's free
+func (gs *GameServer) restoreID(o game.Object, id int) {
+	if id <= 0 || gs.Objects.FindObjectByID(id) != nil {
+		return
+	}
+
+	o.SetID(id)
+	gs.IDs.Reserve(id)
+}
@@ -2,28 +2,109 @@ package main
 
 import (
 	"fmt"
-	"github.com/mischief/gochanio"
 	"github.com/mischief/goland/game"
 	"github.com/mischief/goland/game/gnet"
 	uuid "github.com/nu7hatch/gouuid"
 	"image"
+	"io"
 	"log"
 	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	// longest username we accept in a hello
+	MAX_USERNAME = 32
+
+	// how long to wait for the client's hello
+	HANDSHAKE_TIMEOUT = 10 * time.Second
 )
 
 type WorldSession struct {
-	Con         net.Conn           // connection to the client
-	ClientRChan <-chan interface{} // client's incoming message channel
-	ClientWChan chan<- interface{} // client's outgoing message channel
-	ID          uuid.UUID          // client's id (account id?)
-	Username    string             // associated username
-	Pos         image.Point        // XXX: what's this for?
-	Player      game.Object        // object this client controls
-	World       *GameServer        // world reference
+	Con      *gnet.Conn  // connection to the client
+	ID       uuid.UUID   // client's id (account id?)
+	Username string      // associated username
+	Pos      image.Point // XXX: what's this for?
+	Player   game.Object // object this client controls
+	World    *GameServer // world reference
+	Features []string    // features negotiated in the handshake
+	loggedIn bool        // Login checked the password, set before any packet is posted
+	Preauth  *Account    // logged in already, by the ssh gateway
+
+	ResumeToken string      // lets a reconnecting client take back Player
+	parked      bool        // disconnected, waiting to be resumed
+	parkTimer   *time.Timer // fires when the grace period runs out
+	savedAt     time.Time   // when Player was last saved to the account
+
+	lastActive time.Time     // last packet that wasn't a ping
+	rtt        time.Duration // round trip time the client last measured
+	kicked     bool          // we hung up on purpose
+	m          sync.Mutex    // protects the above
+
+	queue *SendQueue // packets waiting for WriteProc
+
+	Spectator bool        // watching, with no Player
+	Camera    game.Camera // where a spectator is looking
+
+	View      *ClientView // world states the client has
+	LastInput uint32      // Seq of the last Taction we ran, see RunIntents
+	joined    bool        // sent Rjoin, so snapshots can follow
 }
 
 func (ws *WorldSession) String() string {
-	return fmt.Sprintf("%s %s %s %s", ws.Con.RemoteAddr(), ws.ID, ws.Pos, ws.Player)
+	return fmt.Sprintf("%s %s %s %s rtt %s queue %d/%d", ws.Con.RemoteAddr(), ws.ID, ws.Pos, ws.Player, ws.RTT(), ws.queue.Stats().Depth, ws.queue.Max)
+}
+
+// QueueStats reports how the client is keeping up with what we send it
+func (ws *WorldSession) QueueStats() SendQueueStats {
+	return ws.queue.Stats()
+}
+
+// RTT is the client's last reported round trip time
+func (ws *WorldSession) RTT() time.Duration {
+	ws.m.Lock()
+	defer ws.m.Unlock()
+
+	return ws.rtt
+}
+
+// note that the client did something other than ping
+func (ws *WorldSession) Touch() {
+	ws.m.Lock()
+	ws.lastActive = time.Now()
+	ws.m.Unlock()
+}
+
+// IdleFor is how long since the client did something other than ping
+func (ws *WorldSession) IdleFor() time.Duration {
+	ws.m.Lock()
+	defer ws.m.Unlock()
+
+	return time.Since(ws.lastActive)
+}
+
+// Kick tells the client why and hangs up. Kicked players aren't
+// parked for resume, and the client knows not to reconnect.
+func (ws *WorldSession) Kick(reason string) {
+	ws.m.Lock()
+	ws.kicked = true
+	ws.m.Unlock()
+
+	log.Printf("WorldSession: Kick: %s: %s (queue %s)", ws.Con.RemoteAddr(), reason, ws.queue.Stats())
+
+	// whatever is still queued doesn't matter anymore. WriteProc
+	// sends the reason and hangs up.
+	ws.queue.Close(gnet.NewPacket("Rbye", reason))
+}
+
+func (ws *WorldSession) Kicked() bool {
+	ws.m.Lock()
+	defer ws.m.Unlock()
+
+	return ws.kicked
 }
 
 func NewWorldSession(w *GameServer, c net.Conn) *WorldSession {
@@ -32,10 +113,8 @@ func NewWorldSession(w *GameServer, c net.Conn) *WorldSession {
 
 	n := new(WorldSession)
 
-	n.Con = c
-
-	n.ClientRChan = chanio.NewReader(n.Con)
-	n.ClientWChan = chanio.NewWriter(n.Con)
+	codec, _ := gnet.GetCodec(gnet.DEFAULT_CODEC)
+	n.Con = gnet.NewConn(c, codec)
 
 	if id, err = uuid.NewV4(); err != nil {
 		log.Printf("NewWorldSession: %s", err)
@@ -45,10 +124,230 @@ func NewWorldSession(w *GameServer, c net.Conn) *WorldSession {
 	}
 
 	n.World = w
+	n.lastActive = time.Now()
+	n.queue = NewSendQueue(w.SendQueueMax, w.SendPolicy)
+	n.View = NewClientView()
 
 	return n
 }
 
+// validate a requested username, returning a reason if it is unusable
+func checkUsername(name string) (string, bool) {
+	if strings.TrimSpace(name) == "" {
+		return "username is empty", false
+	}
+
+	if len(name) > MAX_USERNAME {
+		return fmt.Sprintf("username is longer than %d bytes", MAX_USERNAME), false
+	}
+
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return "username contains unprintable characters", false
+		}
+	}
+
+	return "", true
+}
+
+// Handshake reads the client's Tconnect hello and answers it with
+// Rconnect or Rreject, then logs the client in. It must be the first
+// thing read from the client.
+// Returns the Tconnect packet on success, or nil if the client was refused.
+func (ws *WorldSession) Handshake() *gnet.Packet {
+	ws.Con.SetReadDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer ws.Con.SetReadDeadline(time.Time{})
+
+	// tools that can't speak gob may say hello in jsonl instead
+	codec, err := ws.Con.Sniff()
+	if err != nil {
+		log.Printf("WorldSession: Handshake: %s hung up before hello: %s", ws.Con.RemoteAddr(), err)
+		ws.Con.Close()
+		return nil
+	}
+
+	ws.Con.SetCodec(codec)
+
+	p, err := ws.Con.ReadPacket()
+	if err != nil {
+		ws.Reject(gnet.REJECT_BADHELLO, fmt.Sprintf("can't read hello: %s", err))
+		return nil
+	}
+
+	if p.Tag != "Tconnect" {
+		ws.Reject(gnet.REJECT_BADHELLO, "expected Tconnect as the first packet")
+		return nil
+	}
+
+	// clients from before the handshake existed send a bare username.
+	// they can't decode a Reject, but they do print Rchat.
+	if name, ok := p.Data.(string); ok {
+		log.Printf("WorldSession: Handshake: %s sent legacy Tconnect for %q", ws.Con.RemoteAddr(), name)
+		ws.writePacket(gnet.NewPacket("Rchat", fmt.Sprintf("This server speaks protocol version %d. Please upgrade your client.", gnet.PROTOCOL_VERSION)))
+		ws.hangup()
+		return nil
+	}
+
+	if err := gnet.Validate(p, gnet.CLIENT_TO_SERVER); err != nil {
+		ws.Reject(gnet.REJECT_BADHELLO, err.Error())
+		return nil
+	}
+
+	hello := p.Data.(*gnet.Hello)
+
+	log.Printf("WorldSession: Handshake: %s %s", ws.Con.RemoteAddr(), hello)
+
+	if hello.Version != gnet.PROTOCOL_VERSION {
+		ws.Reject(gnet.REJECT_VERSION, fmt.Sprintf("client speaks protocol version %d, server speaks %d", hello.Version, gnet.PROTOCOL_VERSION))
+		return nil
+	}
+
+	if why, ok := checkUsername(hello.Username); !ok {
+		ws.Reject(gnet.REJECT_USERNAME, why)
+		return nil
+	}
+
+	ws.Username = hello.Username
+	ws.capture(gnet.CAPTURE_IN, p)
+
+	ws.Features = gnet.NegotiateFeatures(hello.Features, Features)
+
+	// if we started in jsonl, stay there
+	if codec.Name() == gnet.DEFAULT_CODEC {
+		codec = gnet.NegotiateCodec(hello.Codecs)
+	}
+
+	if ws.HasFeature("resume") {
+		if token, err := NewResumeToken(); err != nil {
+			log.Printf("WorldSession: Handshake: can't make resume token: %s", err)
+		} else {
+			ws.ResumeToken = token
+		}
+	}
+
+	ws.writePacket(gnet.NewPacket("Rconnect", &gnet.Welcome{
+		Version:       gnet.PROTOCOL_VERSION,
+		ServerName:    SERVER_NAME,
+		ServerVersion: SERVER_VERSION,
+		Features:      ws.Features,
+		Codec:         codec.Name(),
+		ResumeToken:   ws.ResumeToken,
+	}))
+
+	// Rconnect went out in the old codec, everything after uses the new one
+	ws.Con.SetCodec(codec)
+
+	log.Printf("WorldSession: Handshake: %s speaking %s", ws.Con.RemoteAddr(), codec.Name())
+
+	if !ws.Login() {
+		return nil
+	}
+
+	return p
+}
+
+// Login reads the client's Tlogin and checks it against the account named
+// in the hello, or registers that account. Answers Rlogin, or Rreject and
+// hangs up. Only called from Handshake.
+func (ws *WorldSession) Login() bool {
+	addr := hostOf(ws.Con.RemoteAddr())
+
+	// banned addresses don't even get to try a password
+	if left, banned := ws.World.Bans.Banned("", addr); banned {
+		ws.Reject(gnet.REJECT_BANNED, fmt.Sprintf("you're banned for another %s", left/time.Second*time.Second))
+		return false
+	}
+
+	p, err := ws.Con.ReadPacket()
+	if err != nil {
+		ws.Reject(gnet.REJECT_AUTH, fmt.Sprintf("can't read login: %s", err))
+		return false
+	}
+
+	ws.capture(gnet.CAPTURE_IN, p)
+
+	if p.Tag != "Tlogin" {
+		ws.Reject(gnet.REJECT_AUTH, "expected Tlogin after Rconnect")
+		return false
+	}
+
+	if err := gnet.Validate(p, gnet.CLIENT_TO_SERVER); err != nil {
+		ws.Reject(gnet.REJECT_AUTH, err.Error())
+		return false
+	}
+
+	login := p.Data.(*gnet.Login)
+
+	var acct *Account
+	if ws.Preauth != nil {
+		// the gateway checked the password and counted the login, but
+		// only for the account it logged in
+		if !strings.EqualFold(ws.Username, ws.Preauth.Name) {
+			ws.Reject(gnet.REJECT_AUTH, fmt.Sprintf("logged in as %s, not %s", ws.Preauth.Name, ws.Username))
+			return false
+		}
+
+		acct = ws.Preauth
+	} else if left, ok := ws.World.Logins.Allow(addr, ws.Username); !ok {
+		ws.Reject(gnet.REJECT_AUTH, fmt.Sprintf("too many failed logins, try again in %s", left/time.Second*time.Second+time.Second))
+		return false
+	} else if login.Register {
+		acct, err = ws.World.Accounts.Register(ws.Username, login.Password)
+	} else {
+		acct, err = ws.World.Accounts.Login(ws.Username, login.Password)
+	}
+
+	if err != nil {
+		log.Printf("WorldSession: Login: %s as %s %s: %s", ws.Con.RemoteAddr(), ws.Username, login, err)
+
+		// only the log says which it was
+		if err == ErrNoAccount || err == ErrBadPassword {
+			ws.World.Logins.Failed(addr, ws.Username)
+			err = ErrBadLogin
+		}
+
+		ws.Reject(gnet.REJECT_AUTH, err.Error())
+		return false
+	}
+
+	if left, banned := ws.World.Bans.Banned(acct.Name, ""); banned {
+		ws.Reject(gnet.REJECT_BANNED, fmt.Sprintf("you're banned for another %s", left/time.Second*time.Second))
+		return false
+	}
+
+	ws.World.Logins.Succeeded(acct.Name)
+
+	// however it was typed, the account's name is the one everyone sees
+	ws.Username = acct.Name
+	ws.loggedIn = true
+
+	log.Printf("WorldSession: Login: %s logged in as %s", ws.Con.RemoteAddr(), ws.Username)
+
+	ws.writePacket(gnet.NewPacket("Rlogin", ws.Username))
+
+	return true
+}
+
+// refuse the client with reason and hang up
+func (ws *WorldSession) Reject(reason gnet.RejectReason, msg string) {
+	rej := &gnet.Reject{Reason: reason, Message: msg, ServerVersion: gnet.PROTOCOL_VERSION}
+
+	log.Printf("WorldSession: Reject: %s %s", ws.Con.RemoteAddr(), rej)
+
+	ws.writePacket(gnet.NewPacket("Rreject", rej))
+	ws.hangup()
+}
+
+// hang up on the client
+func (ws *WorldSession) hangup() {
+	ws.Con.Close()
+}
+
+// HasFeature reports whether feature was negotiated for this session
+func (ws *WorldSession) HasFeature(feature string) bool {
+	return gnet.HasFeature(ws.Features, feature)
+}
+
 // handle per-client packets
 func (ws *WorldSession) ReceiveProc() {
 	defer func() {
@@ -57,35 +356,168 @@ func (ws *WorldSession) ReceiveProc() {
 		}
 	}()
 
-	for x := range ws.ClientRChan {
-		p, ok := x.(*gnet.Packet)
-		if !ok {
-			log.Printf("WorldSession: ReceiveProc: bad packet %#v from %s", x, ws.Con.RemoteAddr())
+	connect := ws.Handshake()
+	if connect == nil {
+		return
+	}
+
+	// from here on everything we send goes through the queue
+	go ws.WriteProc()
+
+	// only sessions that finished the handshake see world traffic
+	ws.World.Attach(ws)
+
+	if !ws.World.Post(&ClientPacket{ws, connect}) {
+		ws.World.Detach(ws)
+		ws.Kick("The server is shutting down.")
+		return
+	}
+
+	// only for what we answer here, the RateLimiter has the rest
+	limits := newSessionLimits(time.Now())
+
+	// live clients that said they'd ping do, so silence means the
+	// connection is dead. the rest only get hung up on when it surely is.
+	timeout := ws.World.DeadPeer
+	if ws.HasFeature("ping") {
+		timeout = ws.World.ReadTimeout
+	}
+
+	for {
+		ws.Con.SetReadDeadline(time.Now().Add(timeout))
+
+		p, err := ws.Con.ReadPacket()
+		if err != nil {
+			// a stream we can't decode can't be resynchronized, so hang up
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				log.Printf("WorldSession: ReceiveProc: %s silent for %s, hanging up", ws.Con.RemoteAddr(), timeout)
+			} else if err != io.EOF {
+				log.Printf("WorldSession: ReceiveProc: read error from %s: %s", ws.Con.RemoteAddr(), err)
+			}
+			ws.Con.Close()
+			break
+		}
+
+		ws.capture(gnet.CAPTURE_IN, p)
+
+		if p.Tag == "Tping" {
+			if !ws.Allow(limits, p.Tag) {
+				continue
+			}
+
+			if err := ws.HandlePing(p); err != nil {
+				log.Printf("WorldSession: ReceiveProc: %s: %s", ws.Con.RemoteAddr(), err)
+			}
+			continue
+		}
+
+		if p.Tag == "Tack" {
+			if !ws.Allow(limits, p.Tag) {
+				continue
+			}
+
+			if err := ws.HandleAck(p); err != nil {
+				log.Printf("WorldSession: ReceiveProc: %s: %s", ws.Con.RemoteAddr(), err)
+			}
 			continue
 		}
 
+		// we made the Tconnect from the handshake and make the Tdisconnect
+		// when the connection goes, so a client sending either is broken
+		// or up to something
+		if p.Tag == "Tconnect" || p.Tag == "Tdisconnect" {
+			ws.Kick(fmt.Sprintf("%s is only allowed once, in the handshake.", p.Tag))
+			break
+		}
+
+		ws.Touch()
+
 		cp := &ClientPacket{ws, p}
 
-		ws.World.PacketChan <- cp
+		if !ws.World.Post(cp) {
+			break
+		}
 	}
 
+	ws.queue.Close(nil)
+
 	dis := &ClientPacket{ws, gnet.NewPacket("Tdisconnect", nil)}
 
-	ws.World.PacketChan <- dis
+	ws.World.Post(dis)
 
 	log.Printf("WorldSession: ReceiveProc: Channel closed %s", ws)
 }
 
-// send packet to this client
+// queue packet for this client
 func (ws *WorldSession) SendPacket(pk *gnet.Packet) {
-	log.Printf("WorldSession: SendPacket: %s %s", ws.Con.RemoteAddr(), pk)
+	ws.enqueue(snapshot(pk))
+}
 
-	defer func() {
-		if err := recover(); err != nil {
-			log.Printf("WorldSession: SendPacket: error: %s", err)
+// queue a packet that is already safe to encode later
+func (ws *WorldSession) enqueue(pk *gnet.Packet) {
+	if err := gnet.Validate(pk, gnet.SERVER_TO_CLIENT); err != nil {
+		log.Printf("WorldSession: SendPacket: not sending: %s", err)
+		return
+	}
+
+	switch err := ws.queue.Push(pk); err {
+	case nil:
+	case ErrQueueFull:
+		ws.Kick("Your connection can't keep up with the game.")
+	default:
+		log.Printf("WorldSession: SendPacket: %s: %s", ws.Con.RemoteAddr(), err)
+	}
+}
+
+// write a packet right now, bypassing the queue. only for the handshake,
+// where the codec may change right after the packet goes out.
+func (ws *WorldSession) writePacket(pk *gnet.Packet) {
+	if err := ws.Con.WritePacket(pk); err != nil {
+		log.Printf("WorldSession: writePacket: %s: %s", ws.Con.RemoteAddr(), err)
+		return
+	}
+
+	ws.capture(gnet.CAPTURE_OUT, pk)
+}
+
+// record pk going dir in the server's packet capture, if there is one
+func (ws *WorldSession) capture(dir string, pk *gnet.Packet) {
+	if err := ws.World.Capture.Write(dir, ws.ID.String(), ws.Username, pk); err != nil {
+		log.Printf("WorldSession: capture: %s: %s", ws.Con.RemoteAddr(), err)
+	}
+}
+
+// WriteProc drains the send queue to the client until it is closed,
+// then hangs up
+func (ws *WorldSession) WriteProc() {
+	warned := false
+
+	for {
+		pk, ok := ws.queue.Pop()
+		if !ok {
+			break
 		}
-	}()
-	ws.ClientWChan <- pk
+
+		ws.Con.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+
+		if err := ws.Con.WritePacket(pk); err != nil {
+			log.Printf("WorldSession: WriteProc: %s: %s", ws.Con.RemoteAddr(), err)
+			ws.queue.Close(nil)
+			break
+		}
+
+		ws.capture(gnet.CAPTURE_OUT, pk)
+
+		// say so once when a client starts falling behind
+		if st := ws.queue.Stats(); !warned && st.Depth > ws.queue.Max/2 {
+			log.Printf("WorldSession: WriteProc: %s falling behind: %s", ws.Con.RemoteAddr(), st)
+			warned = true
+		}
+	}
+
+	log.Printf("WorldSession: WriteProc: %s done: %s", ws.Con.RemoteAddr(), ws.queue.Stats())
+
+	ws.hangup()
 }
 
 func (ws *WorldSession) Update() {